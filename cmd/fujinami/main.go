@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	proxy "gosmtp/src"
+	"gosmtp/src/store"
+)
+
+var configPath = flag.String("config", "/etc/fujinami/fujinami.yaml", "path to the YAML or TOML config file")
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		passwd(os.Args[2:])
+		return
+	}
+	flag.Parse()
+
+	conf, err := proxy.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := store.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	be := proxy.NewBackend(conf)
+
+	done := make(chan struct{})
+	defer close(done)
+	go be.RunHealthChecks(done)
+	go be.RunPoolReaper(done)
+
+	if conf.Spool.Dir != "" {
+		sp, err := proxy.OpenSpool(be, conf.Spool)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sp.Start()
+		defer sp.Close()
+	}
+
+	var servers []*smtp.Server
+	errc := make(chan error, len(conf.Listeners))
+	for _, l := range conf.Listeners {
+		s := newServer(be.ForListener(l), conf, l)
+		servers = append(servers, s)
+
+		go func(s *smtp.Server, l proxy.Listener) {
+			log.Println("[listen]", l.Role, s.Addr)
+			errc <- serve(be, s, l)
+		}(s, l)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+loop:
+	for {
+		select {
+		case err = <-errc:
+			log.Println("[listen]", err)
+			break loop
+		case s := <-sig:
+			log.Println("[signal]", s)
+			switch s {
+			case syscall.SIGHUP:
+				reload(be)
+			case syscall.SIGUSR1:
+				logPoolStats(be)
+			default:
+				break loop
+			}
+		}
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+func reload(be *proxy.Backend) {
+	conf, err := proxy.LoadConfig(*configPath)
+	if err != nil {
+		log.Println("[reload] keeping current config:", err)
+		return
+	}
+	if err := be.Reload(conf); err != nil {
+		log.Println("[reload] keeping current config:", err)
+	}
+}
+
+func logPoolStats(be *proxy.Backend) {
+	for _, st := range be.PoolStats() {
+		log.Printf("[pool] %s idle=%d dials=%d reuses=%d evictions=%d\n", st.Addr, st.Idle, st.Dials, st.Reuses, st.Evictions)
+	}
+}
+
+// serve runs s on the address of l. Inbound connections are counted
+// against the rate limits as they are accepted.
+func serve(be *proxy.Backend, s *smtp.Server, l proxy.Listener) error {
+	switch l.Role {
+	case proxy.RoleSubmissions:
+		return s.ListenAndServeTLS()
+	case proxy.RoleMX:
+		ln, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			return err
+		}
+		return s.Serve(be.LimitListener(ln))
+	}
+	return s.ListenAndServe()
+}
+
+func newServer(be smtp.Backend, conf *proxy.Config, l proxy.Listener) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Addr = l.Address()
+	s.Domain = conf.ServerName
+	s.TLSConfig = l.TlsConfig
+	s.ReadTimeout = time.Duration(l.ReadTimeout) * time.Second
+	s.WriteTimeout = time.Duration(l.WriteTimeout) * time.Second
+	s.MaxMessageBytes = l.MaxMessageBytes
+	s.EnableSMTPUTF8 = true
+	s.AuthDisabled = l.Role == proxy.RoleMX
+	return s
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	proxy "gosmtp/src"
+)
+
+// passwd prints a password hash for use as password_hash in the config or,
+// when a user name is given, as an htpasswd line.
+func passwd(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	scheme := fs.String("scheme", proxy.HashBcrypt, "hash scheme, bcrypt or argon2id")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: fujinami passwd [-scheme bcrypt|argon2id] [user]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	password, err := readPassword()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hash, err := proxy.HashPassword(*scheme, password)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Printf("%s:%s\n", fs.Arg(0), hash)
+	} else {
+		fmt.Println(hash)
+	}
+}
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if err != nil {
+				return "", err
+			}
+			return "", errors.New("empty password")
+		}
+		return line, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype password: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if len(p1) == 0 {
+		return "", errors.New("empty password")
+	}
+	if string(p1) != string(p2) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(p1), nil
+}
@@ -3,6 +3,7 @@ module gosmtp
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/emersion/go-dkim v0.3.0
 	github.com/emersion/go-msgauth v0.6.5
 	github.com/emersion/go-smtp v0.12.0
@@ -11,10 +12,12 @@ require (
 	github.com/miekg/dns v1.1.42 // indirect
 	github.com/mileusna/spf v0.9.3
 	github.com/prologic/bitcask v0.3.10
-	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf // indirect
-	golang.org/x/net v0.0.0-20210508051633-16afe75a6701 // indirect
+	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf
+	golang.org/x/net v0.0.0-20210508051633-16afe75a6701
 	golang.org/x/sys v0.0.0-20210507161434-a76c4d0a0096 // indirect
-	gopkg.in/mrichman/godnsbl.v1 v1.0.0 // indirect
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	gopkg.in/mrichman/godnsbl.v1 v1.0.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 replace github.com/emersion/go-smtp => ../go-smtp
@@ -12,14 +12,22 @@ func Allocate(ctx context.Context, from, to string) error {
 
 	if ok := AllowedTo(conf.Allocation, to); !ok {
 		log.Printf("[at] deny to: %s from: %s\n", to, from)
-		return NewNotMemberError(to)
+		return NewUnknownRecipientError(to)
 	}
 
-	if ok := AllowedFrom(conf.Allocation, from); !ok {
+	return allocateFrom(conf.Allocation, from, to)
+}
+
+// allocateFrom refuses senders of the blacklisted hosts. The null sender of
+// a bounce has no host to check.
+func allocateFrom(a AllocationSetting, from, to string) error {
+	if from == "" {
+		return nil
+	}
+	if ok := AllowedFrom(a, from); !ok {
 		log.Printf("[af] deny to: %s from: %s\n", to, from)
 		return NewNotMemberError(to)
 	}
-
 	return nil
 }
 
@@ -29,23 +37,79 @@ func AllowedFrom(a AllocationSetting, from string) bool {
 		return false
 	}
 
-	_, ok := a.BlacklistHosts[strings.ToLower(host)]
+	_, ok := a.BlacklistHosts[normalizeHost(host)]
 	return !ok
 }
 
 func AllowedTo(a AllocationSetting, to string) bool {
-	_, host := StripEmail(to)
+	_, ok := a.Route(to)
+	return ok
+}
+
+// AllowedSender reports whether from is one of our addresses, by a route,
+// ToAddresses or ToDomains. A "*" route forwards mail for any domain but
+// doesn't make it ours.
+func AllowedSender(a AllocationSetting, from string) bool {
+	_, ok := a.route(from, false)
+	return ok
+}
+
+// Route finds the routing entry for a recipient. The most specific match
+// wins: the full address, then "*@domain" or "domain", then "*.domain" for
+// subdomains (longest first), then "*". ToAddresses and ToDomains are
+// consulted when no route matches and route to the defaults.
+func (a AllocationSetting) Route(to string) (Route, bool) {
+	return a.route(to, true)
+}
+
+func (a AllocationSetting) route(to string, catchAll bool) (Route, bool) {
+	local, host := StripEmail(to)
 	if len(host) == 0 {
-		return false
+		return Route{}, false
+	}
+	host = normalizeHost(host)
+	addr := strings.ToLower(local) + "@" + host
+
+	best, score := -1, 0
+	if !catchAll {
+		// Only routes scoring above "*" win.
+		score = 1
+	}
+	for n, r := range a.Routes {
+		if sc := r.score(addr, host); sc > score {
+			best, score = n, sc
+		}
+	}
+	if best >= 0 {
+		return a.Routes[best], true
+	}
+
+	if ad, ok := a.ToAddresses[addr]; ok {
+		return Route{}, ad
 	}
 
 	if ad, ok := a.ToAddresses[host]; ok {
-		return ad
+		return Route{}, ad
 	}
 
 	if ad, ok := a.ToDomains[host]; ok {
-		return ad
+		return Route{}, ad
 	}
 
-	return false
+	return Route{}, false
+}
+
+func (r Route) score(addr, host string) int {
+	p := strings.ToLower(r.Pattern)
+	switch {
+	case p == addr:
+		return 3 << 16
+	case p == host, p == "*@"+host, p == "@"+host:
+		return 2 << 16
+	case strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]):
+		return 1<<16 + len(p)
+	case p == "*":
+		return 1
+	}
+	return 0
 }
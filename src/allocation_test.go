@@ -0,0 +1,56 @@
+package proxy
+
+import "testing"
+
+func TestRoute(t *testing.T) {
+	a := AllocationSetting{
+		ToAddresses: map[string]bool{"info@example.net": true},
+		ToDomains:   map[string]bool{"example.com": true},
+		Routes: []Route{
+			{Pattern: "*", Upstream: "any"},
+			{Pattern: "*.example.org", Upstream: "sub"},
+			{Pattern: "*.mail.example.org", Upstream: "mail"},
+			{Pattern: "example.org", Upstream: "domain"},
+			{Pattern: "*@shop.example.org", Upstream: "shop"},
+			{Pattern: "ceo@example.org", Upstream: "exact"},
+		},
+	}
+	tests := []struct {
+		to       string
+		upstream string
+		ok       bool
+		sender   bool
+	}{
+		{"ceo@example.org", "exact", true, true},
+		{"CEO@Example.ORG", "exact", true, true},
+		{"sales@example.org", "domain", true, true},
+		{"sales@shop.example.org", "shop", true, true},
+		{"sales@eu.example.org", "sub", true, true},
+		{"sales@eu.mail.example.org", "mail", true, true},
+		{"sales@example.net", "any", true, false},
+		// Routes come before ToAddresses and ToDomains, "*" included.
+		{"info@example.net", "any", true, true},
+		{"sales@example.com", "any", true, true},
+		{"example.org", "", false, false},
+	}
+	for _, tt := range tests {
+		r, ok := a.Route(tt.to)
+		if r.Upstream != tt.upstream || ok != tt.ok {
+			t.Errorf("Route(%s) = %q, %v, want %q, %v", tt.to, r.Upstream, ok, tt.upstream, tt.ok)
+		}
+		if got := AllowedSender(a, tt.to); got != tt.sender {
+			t.Errorf("AllowedSender(%s) = %v", tt.to, got)
+		}
+	}
+
+	// Without "*" the defaults take the rest.
+	a.Routes = a.Routes[1:]
+	for _, to := range []string{"info@example.net", "sales@example.com"} {
+		if r, ok := a.Route(to); !ok || r.Upstream != "" {
+			t.Errorf("Route(%s) = %+v, %v", to, r, ok)
+		}
+	}
+	if _, ok := a.Route("sales@example.net"); ok {
+		t.Error("sales@example.net routed")
+	}
+}
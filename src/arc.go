@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCResult is the state of an ARC chain (RFC 8617), also used as the cv=
+// value of the seal we add.
+type ARCResult string
+
+const (
+	ARCNone ARCResult = "none"
+	ARCPass ARCResult = "pass"
+	ARCFail ARCResult = "fail"
+)
+
+const arcMaxInstance = 50
+
+// ARCSigner holds the key material for sealing, the same key used for DKIM.
+type ARCSigner struct {
+	Domain   string
+	Selector string
+	Key      *rsa.PrivateKey
+}
+
+// arcSignedHeaders are signed by our ARC-Message-Signature when present.
+var arcSignedHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+var lookupTXT = net.LookupTXT
+
+type arcSet struct {
+	aar, ams, as string
+}
+
+// ARCSeal adds a new ARC set on top of msg. results is the payload of the
+// ARC-Authentication-Results field after the instance tag, cv the result
+// of verifying the chain msg arrived with.
+func ARCSeal(msg []byte, signer *ARCSigner, cv ARCResult, results string) ([]byte, error) {
+	fields, body := splitMessage(msg)
+
+	sets, err := arcSets(fields)
+	if err != nil && cv != ARCFail {
+		return nil, err
+	}
+	n := len(sets) + 1
+	if err != nil {
+		n = arcHighestInstance(fields) + 1
+	}
+	if n > arcMaxInstance {
+		return nil, errors.New("arc: too many ARC sets")
+	}
+	if n == 1 {
+		cv = ARCNone
+	}
+
+	t := strconv.FormatInt(time.Now().Unix(), 10)
+
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s\r\n", n, results)
+
+	bh := sha256.Sum256(canonBody(body, true))
+	var names []string
+	for _, k := range arcSignedHeaders {
+		for _, f := range fields {
+			if strings.EqualFold(fieldName(f), k) {
+				names = append(names, strings.ToLower(k))
+			}
+		}
+	}
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=rsa-sha256; c=relaxed/relaxed;\r\n"+
+		"\td=%s; s=%s; t=%s;\r\n"+
+		"\th=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		n, signer.Domain, signer.Selector, t, strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	sig, err := rsaSign(signer.Key, headerHashInput(fields, names, ams, true))
+	if err != nil {
+		return nil, err
+	}
+	ams += foldBase64(sig) + "\r\n"
+
+	as := fmt.Sprintf("ARC-Seal: i=%d; a=rsa-sha256; t=%s; cv=%s;\r\n"+
+		"\td=%s; s=%s;\r\n"+
+		"\tb=",
+		n, t, cv, signer.Domain, signer.Selector)
+
+	// A failed chain can't be vouched for, so the seal then covers only
+	// our own set.
+	var sealed []arcSet
+	if cv != ARCFail {
+		sealed = sets
+	}
+	sealed = append(sealed, arcSet{aar: aar, ams: ams, as: as})
+	sig, err = rsaSign(signer.Key, sealHashInput(sealed))
+	if err != nil {
+		return nil, err
+	}
+	as += foldBase64(sig) + "\r\n"
+
+	out := new(bytes.Buffer)
+	out.WriteString(as)
+	out.WriteString(ams)
+	out.WriteString(aar)
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// VerifyARC validates the ARC chain of an inbound message: the sets must be
+// complete and numbered 1..N, every seal must verify and so must the most
+// recent message signature.
+func VerifyARC(msg []byte) (ARCResult, error) {
+	fields, body := splitMessage(msg)
+
+	sets, err := arcSets(fields)
+	if err != nil {
+		return ARCFail, err
+	}
+	if len(sets) == 0 {
+		return ARCNone, nil
+	}
+	if len(sets) > arcMaxInstance {
+		return ARCFail, errors.New("arc: too many ARC sets")
+	}
+
+	for i, set := range sets {
+		want := ARCPass
+		if i == 0 {
+			want = ARCNone
+		}
+		if cv := ARCResult(strings.ToLower(parseTags(fieldValue(set.as))["cv"])); cv != want {
+			return ARCFail, fmt.Errorf("arc: i=%d has cv=%s", i+1, cv)
+		}
+	}
+
+	if err := verifyAMS(fields, body, sets[len(sets)-1].ams); err != nil {
+		return ARCFail, fmt.Errorf("arc: i=%d message signature: %s", len(sets), err)
+	}
+
+	for i := len(sets); i > 0; i-- {
+		tags := parseTags(fieldValue(sets[i-1].as))
+		if tags["a"] != "rsa-sha256" {
+			return ARCFail, fmt.Errorf("arc: i=%d unsupported algorithm %q", i, tags["a"])
+		}
+		if err := verifyRSA(tags["d"], tags["s"], sealHashInput(sets[:i]), tags["b"]); err != nil {
+			return ARCFail, fmt.Errorf("arc: i=%d seal: %s", i, err)
+		}
+	}
+	return ARCPass, nil
+}
+
+func verifyAMS(fields []string, body []byte, ams string) error {
+	tags := parseTags(fieldValue(ams))
+	if tags["a"] != "rsa-sha256" {
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+
+	hc, bc := "simple", "simple"
+	if c := strings.SplitN(tags["c"], "/", 2); c[0] != "" {
+		hc = c[0]
+		if len(c) == 2 {
+			bc = c[1]
+		}
+	}
+
+	bh := sha256.Sum256(canonBody(body, bc == "relaxed"))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	var names []string
+	for _, k := range strings.Split(tags["h"], ":") {
+		if k = strings.TrimSpace(k); k != "" {
+			names = append(names, k)
+		}
+	}
+	return verifyRSA(tags["d"], tags["s"], headerHashInput(fields, names, ams, hc == "relaxed"), tags["b"])
+}
+
+// arcSets returns the ARC sets of a message ordered by instance.
+func arcSets(fields []string) ([]arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	for _, f := range fields {
+		var slot func(*arcSet) *string
+		switch strings.ToLower(fieldName(f)) {
+		case "arc-authentication-results":
+			slot = func(s *arcSet) *string { return &s.aar }
+		case "arc-message-signature":
+			slot = func(s *arcSet) *string { return &s.ams }
+		case "arc-seal":
+			slot = func(s *arcSet) *string { return &s.as }
+		default:
+			continue
+		}
+
+		i, err := strconv.Atoi(parseTags(fieldValue(f))["i"])
+		if err != nil || i < 1 {
+			return nil, errors.New("arc: invalid instance")
+		}
+		set, ok := byInstance[i]
+		if !ok {
+			set = new(arcSet)
+			byInstance[i] = set
+		}
+		p := slot(set)
+		if *p != "" {
+			return nil, fmt.Errorf("arc: duplicate %s for i=%d", fieldName(f), i)
+		}
+		*p = f
+	}
+
+	sets := make([]arcSet, len(byInstance))
+	for i := 1; i <= len(byInstance); i++ {
+		set, ok := byInstance[i]
+		if !ok {
+			return nil, fmt.Errorf("arc: missing i=%d", i)
+		}
+		if set.aar == "" || set.ams == "" || set.as == "" {
+			return nil, fmt.Errorf("arc: incomplete set i=%d", i)
+		}
+		sets[i-1] = *set
+	}
+	return sets, nil
+}
+
+func arcHighestInstance(fields []string) int {
+	n := 0
+	for _, f := range fields {
+		if strings.HasPrefix(strings.ToLower(fieldName(f)), "arc-") {
+			if i, err := strconv.Atoi(parseTags(fieldValue(f))["i"]); err == nil && i > n {
+				n = i
+			}
+		}
+	}
+	return n
+}
+
+// sealHashInput is the data signed by the seal of the last set: every set
+// in order, with the b= value of the last seal removed.
+func sealHashInput(sets []arcSet) []byte {
+	buf := new(bytes.Buffer)
+	for i, set := range sets {
+		buf.WriteString(canonHeader(set.aar, true))
+		buf.WriteString(canonHeader(set.ams, true))
+		if i < len(sets)-1 {
+			buf.WriteString(canonHeader(set.as, true))
+		} else {
+			buf.WriteString(strings.TrimSuffix(canonHeader(stripSignature(set.as), true), "\r\n"))
+		}
+	}
+	return buf.Bytes()
+}
+
+// headerHashInput selects the signed fields bottom up, as DKIM does, and
+// appends the signature field itself without its b= value.
+func headerHashInput(fields, names []string, sig string, relaxed bool) []byte {
+	buf := new(bytes.Buffer)
+	picked := map[string]int{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		skip := picked[key]
+		picked[key]++
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.ToLower(fieldName(fields[i])) != key {
+				continue
+			}
+			if skip == 0 {
+				buf.WriteString(canonHeader(fields[i], relaxed))
+				break
+			}
+			skip--
+		}
+	}
+	buf.WriteString(strings.TrimSuffix(canonHeader(stripSignature(sig), relaxed), "\r\n"))
+	return buf.Bytes()
+}
+
+func rsaSign(key *rsa.PrivateKey, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func verifyRSA(domain, selector string, data []byte, b string) error {
+	sig, err := base64.StdEncoding.DecodeString(b)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	pub, err := lookupKey(domain, selector)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+}
+
+func lookupKey(domain, selector string) (*rsa.PublicKey, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("missing d= or s=")
+	}
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := parseTags(strings.Join(txts, ""))
+	if k := tags["k"]; k != "" && k != "rsa" {
+		return nil, fmt.Errorf("unsupported key type %q", k)
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, errors.New("no public key")
+	}
+
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+			return rsaPub, nil
+		}
+		return nil, errors.New("not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+// splitMessage returns the raw header fields, each with its folding and
+// trailing CRLF, and the body.
+func splitMessage(msg []byte) ([]string, []byte) {
+	var fields []string
+	rest := msg
+	for len(rest) > 0 {
+		l := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if l < 0 {
+			line, rest = rest, nil
+		} else {
+			line, rest = rest[:l+1], rest[l+1:]
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		if text == "" {
+			break
+		}
+		text += "\r\n"
+		if (text[0] == ' ' || text[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += text
+		} else {
+			fields = append(fields, text)
+		}
+	}
+	return fields, rest
+}
+
+func fieldName(f string) string {
+	if l := strings.IndexByte(f, ':'); l >= 0 {
+		return strings.TrimSpace(f[:l])
+	}
+	return strings.TrimSpace(f)
+}
+
+func fieldValue(f string) string {
+	if l := strings.IndexByte(f, ':'); l >= 0 {
+		return f[l+1:]
+	}
+	return ""
+}
+
+var reduceWS = regexp.MustCompile(`[ \t\r\n]+`)
+
+func canonHeader(f string, relaxed bool) string {
+	if !relaxed {
+		return f
+	}
+	v := strings.TrimSpace(reduceWS.ReplaceAllString(fieldValue(f), " "))
+	return strings.ToLower(fieldName(f)) + ":" + v + "\r\n"
+}
+
+func canonBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	if relaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(reduceWS.ReplaceAllString(line, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+var signatureValue = regexp.MustCompile(`([;:]\s*b\s*=)[^;]*`)
+
+func stripSignature(f string) string {
+	return signatureValue.ReplaceAllString(f, "$1")
+}
+
+// parseTags parses a tag=value list. Whitespace is removed from values,
+// which is harmless for the tags used here and required for b= and bh=.
+func parseTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = reduceWS.ReplaceAllString(kv[1], "")
+	}
+	return tags
+}
+
+func foldBase64(s string) string {
+	var lines []string
+	for len(s) > 72 {
+		lines = append(lines, s[:72])
+		s = s[72:]
+	}
+	return strings.Join(append(lines, s), "\r\n\t")
+}
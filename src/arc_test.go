@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+var testKey *rsa.PrivateKey
+
+func signingKey(t *testing.T) *rsa.PrivateKey {
+	if testKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	}
+	return testKey
+}
+
+// useFakeTXT serves the TXT records in records instead of DNS.
+func useFakeTXT(t *testing.T, records map[string]string) {
+	old := lookupTXT
+	lookupTXT = func(name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return []string{txt}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	t.Cleanup(func() { lookupTXT = old })
+}
+
+// testSigner returns a signer for d=example.org s=test whose public key is
+// published with useFakeTXT.
+func testSigner(t *testing.T) *ARCSigner {
+	key := signingKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFakeTXT(t, map[string]string{
+		"test._domainkey.example.org": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der),
+	})
+	return &ARCSigner{Domain: "example.org", Selector: "test", Key: key}
+}
+
+const testMessage = "From: Alice <alice@example.net>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: hello\r\n" +
+	"Date: Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+	"\r\n" +
+	"Hi Bob,\r\n" +
+	"see you.\r\n"
+
+func TestCanonBody(t *testing.T) {
+	tests := []struct {
+		body    string
+		relaxed bool
+		want    string
+	}{
+		{"", false, "\r\n"},
+		{"", true, ""},
+		{"\r\n\r\n", false, "\r\n"},
+		{"\r\n\r\n", true, ""},
+		{" C \r\nD \t E\r\n\r\n\r\n", false, " C \r\nD \t E\r\n"},
+		{" C \r\nD \t E\r\n\r\n\r\n", true, " C\r\nD E\r\n"},
+		{"no final newline", false, "no final newline\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(canonBody([]byte(tt.body), tt.relaxed)); got != tt.want {
+			t.Errorf("canonBody(%q, %v) = %q, want %q", tt.body, tt.relaxed, got, tt.want)
+		}
+	}
+}
+
+func TestCanonHeader(t *testing.T) {
+	tests := []struct {
+		field   string
+		relaxed bool
+		want    string
+	}{
+		{"A: X\r\n", true, "a:X\r\n"},
+		{"B : Y\t\r\n\tZ  \r\n", true, "b:Y Z\r\n"},
+		{"B : Y\t\r\n\tZ  \r\n", false, "B : Y\t\r\n\tZ  \r\n"},
+		{"Subject:\r\n", true, "subject:\r\n"},
+	}
+	for _, tt := range tests {
+		if got := canonHeader(tt.field, tt.relaxed); got != tt.want {
+			t.Errorf("canonHeader(%q, %v) = %q, want %q", tt.field, tt.relaxed, got, tt.want)
+		}
+	}
+}
+
+func TestARCSealVerify(t *testing.T) {
+	signer := testSigner(t)
+
+	seal := func(msg string, cv ARCResult) string {
+		sealed, err := ARCSeal([]byte(msg), signer, cv, "mx.example.org; spf=pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(sealed)
+	}
+	once := seal(testMessage, ARCNone)
+	twice := seal(once, ARCPass)
+
+	tests := []struct {
+		name string
+		msg  string
+		want ARCResult
+	}{
+		{"unsealed", testMessage, ARCNone},
+		{"one set", once, ARCPass},
+		{"two sets", twice, ARCPass},
+		{"body changed", strings.Replace(once, "see you.", "send money.", 1), ARCFail},
+		{"body whitespace changed", strings.Replace(once, "see you.", "see  you. ", 1), ARCPass},
+		{"signed header changed", strings.Replace(once, "Subject: hello", "Subject: win", 1), ARCFail},
+		{"signed header refolded", strings.Replace(once, "Subject: hello", "Subject:\r\n\thello", 1), ARCPass},
+		{"older results changed", strings.Replace(twice, "i=1; mx.example.org; spf=pass", "i=1; mx.example.org; spf=fail", 1), ARCFail},
+		{"newest results changed", strings.Replace(twice, "i=2; mx.example.org; spf=pass", "i=2; mx.example.org; spf=fail", 1), ARCFail},
+		{"cv none on second set", strings.Replace(twice, "cv=pass", "cv=none", 1), ARCFail},
+		{"set missing", removeFields(twice, "i=1;"), ARCFail},
+		{"incomplete set", removeField(once, "ARC-Seal:"), ARCFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyARC([]byte(tt.msg))
+			if got != tt.want {
+				t.Errorf("VerifyARC = %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestARCUnknownKey(t *testing.T) {
+	sealed, err := ARCSeal([]byte(testMessage), testSigner(t), ARCNone, "mx.example.org; spf=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFakeTXT(t, nil)
+	if got, err := VerifyARC(sealed); got != ARCFail || err == nil {
+		t.Errorf("VerifyARC without key = %s, %v", got, err)
+	}
+}
+
+// removeField drops the first header field starting with prefix.
+func removeField(msg, prefix string) string {
+	fields, body := splitMessage([]byte(msg))
+	for i, f := range fields {
+		if strings.HasPrefix(f, prefix) {
+			fields = append(fields[:i], fields[i+1:]...)
+			break
+		}
+	}
+	return strings.Join(fields, "") + "\r\n" + string(body)
+}
+
+// removeFields drops every ARC field containing tag.
+func removeFields(msg, tag string) string {
+	fields, body := splitMessage([]byte(msg))
+	var kept []string
+	for _, f := range fields {
+		if !strings.HasPrefix(f, "ARC-") || !strings.Contains(f, tag) {
+			kept = append(kept, f)
+		}
+	}
+	return strings.Join(kept, "") + "\r\n" + string(body)
+}
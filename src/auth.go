@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// UserStore authenticates submission users. Config.Users is used when a
+// Config doesn't set one.
+type UserStore interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// SenderStore can be implemented by a UserStore to restrict the envelope
+// and header From addresses a user may send as.
+type SenderStore interface {
+	AllowedSenders(username string) []string
+}
+
+type userList []User
+
+func (l userList) Authenticate(username, password string) (bool, error) {
+	for _, usr := range l {
+		if usr.Name == username {
+			return usr.Check(password)
+		}
+	}
+	return refuse(password)
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash string
+)
+
+// refuse checks password against a dummy hash, so that an unknown user
+// takes about as long to refuse as a wrong password.
+func refuse(password string) (bool, error) {
+	dummyOnce.Do(func() {
+		dummyHash, _ = HashPassword(HashBcrypt, "dummy")
+	})
+	CheckPassword(dummyHash, password)
+	return false, nil
+}
+
+// Check compares password against the user's hash, falling back to the
+// cleartext PlainPassword for configs that haven't been migrated yet.
+func (u User) Check(password string) (bool, error) {
+	if u.Password != "" {
+		return CheckPassword(u.Password, password)
+	}
+	if u.PlainPassword == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(u.PlainPassword), []byte(password)) == 1, nil
+}
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2KeyLen  = 32
+
+	// Hashes asking for more are refused, as every login with them would
+	// cost that much.
+	argon2MaxMemory = 1024 * 1024
+	argon2MaxKeyLen = 64
+)
+
+func HashPassword(scheme, password string) (string, error) {
+	switch scheme {
+	case HashBcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	case HashArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+	return "", fmt.Errorf("unknown hash scheme %q", scheme)
+}
+
+// CheckPassword verifies password against a bcrypt ($2a$, $2b$, $2y$) or
+// argon2id (PHC string format) hash.
+func CheckPassword(hash, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(hash, password)
+	}
+	return false, ErrUnknownHash
+}
+
+// checkHash returns ErrUnknownHash unless CheckPassword can verify
+// passwords against hash. It doesn't hash anything.
+func checkHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return ErrUnknownHash
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2id(hash)
+		return err
+	}
+	return ErrUnknownHash
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+type argon2Hash struct {
+	memory, iterations uint32
+	threads            uint8
+	salt, key          []byte
+}
+
+func parseArgon2id(hash string) (*argon2Hash, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrUnknownHash
+	}
+
+	h := new(argon2Hash)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if h.iterations < 1 || h.threads < 1 || h.memory > argon2MaxMemory {
+		return nil, ErrUnknownHash
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 || len(h.key) > argon2MaxKeyLen {
+		return nil, ErrUnknownHash
+	}
+	return h, nil
+}
+
+func checkArgon2id(hash, password string) (bool, error) {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(h.key, other) == 1, nil
+}
+
+// HtpasswdStore reads "user:hash" lines from an htpasswd compatible file.
+// The file is reread when its modification time changes.
+type HtpasswdStore struct {
+	Path    string
+	Senders map[string][]string
+
+	mu    sync.Mutex
+	mtime time.Time
+	users map[string]string
+}
+
+func NewHtpasswdStore(path string) (*HtpasswdStore, error) {
+	s := &HtpasswdStore{Path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *HtpasswdStore) load() error {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	if !fi.ModTime().After(s.mtime) && s.users != nil {
+		return nil
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l := strings.Index(line, ":")
+		if l < 1 {
+			return fmt.Errorf("%s:%d: malformed line", s.Path, n)
+		}
+		if err := checkHash(line[l+1:]); err != nil {
+			return fmt.Errorf("%s:%d: user %q: %s", s.Path, n, line[:l], err)
+		}
+		users[line[:l]] = line[l+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.users = users
+	s.mtime = fi.ModTime()
+	return nil
+}
+
+func (s *HtpasswdStore) AllowedSenders(username string) []string {
+	return s.Senders[username]
+}
+
+func (s *HtpasswdStore) Authenticate(username, password string) (bool, error) {
+	s.mu.Lock()
+	if err := s.load(); err != nil {
+		if s.users == nil {
+			s.mu.Unlock()
+			return false, err
+		}
+		log.Println("[htpasswd] using cached users:", err)
+	}
+	hash, ok := s.users[username]
+	s.mu.Unlock()
+
+	if !ok {
+		return refuse(password)
+	}
+	return CheckPassword(hash, password)
+}
+
+// AllowedSenders returns the addresses and domains username may send as.
+// A nil result means the user isn't restricted.
+func (c *Config) AllowedSenders(username string) []string {
+	for _, u := range c.Users {
+		if u.Name == username {
+			return u.AllowedFrom
+		}
+	}
+	if ss, ok := c.UserStore.(SenderStore); ok {
+		return ss.AllowedSenders(username)
+	}
+	return nil
+}
+
+// MaxMessageBytes returns the size limit of username, zero if it has none.
+func (c *Config) MaxMessageBytes(username string) int {
+	for _, u := range c.Users {
+		if u.Name == username {
+			return u.MaxMessageBytes
+		}
+	}
+	return 0
+}
+
+// SenderAllowed reports whether addr matches one of allowed, which holds
+// full addresses ("alice@example.com") or domains ("example.com" or
+// "@example.com").
+func SenderAllowed(allowed []string, addr string) bool {
+	if allowed == nil {
+		return true
+	}
+
+	local, host := StripEmail(addr)
+	if host == "" {
+		return false
+	}
+	host = normalizeHost(host)
+
+	for _, a := range allowed {
+		a = normalizeKey(a)
+		if l, h := StripEmail(a); h != "" {
+			if h == host && strings.EqualFold(l, local) {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(a, "@") == host {
+			return true
+		}
+	}
+	return false
+}
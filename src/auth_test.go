@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHash(t *testing.T) {
+	bcryptHash, err := HashPassword(HashBcrypt, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argonHash, err := HashPassword(HashArgon2id, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		hash  string
+		known bool
+	}{
+		{"bcrypt", bcryptHash, true},
+		{"bcrypt $2y$", "$2y$" + bcryptHash[4:], true},
+		{"argon2id", argonHash, true},
+		{"cleartext", "secret", false},
+		{"apr1", "$apr1$salt$hash", false},
+		{"sha1", "{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=", false},
+		{"crypt", "rqXexS6ZhobKA", false},
+		{"truncated bcrypt", bcryptHash[:20], false},
+		{"argon2i", strings.Replace(argonHash, "$argon2id$", "$argon2i$", 1), false},
+		{"argon2id old version", strings.Replace(argonHash, "v=19", "v=16", 1), false},
+		{"argon2id without key", argonHash[:strings.LastIndex(argonHash, "$")+1], false},
+		{"argon2id t=0", strings.Replace(argonHash, "t=3", "t=0", 1), false},
+		{"argon2id p=0", strings.Replace(argonHash, "p=2", "p=0", 1), false},
+		{"argon2id p=256", strings.Replace(argonHash, "p=2", "p=256", 1), false},
+		{"argon2id 16GiB", strings.Replace(argonHash, "m=65536", "m=16777216", 1), false},
+		{"argon2id over 1GiB", strings.Replace(argonHash, "m=65536", "m=1048577", 1), false},
+		{"argon2id long key", argonHash + strings.Repeat("A", 80), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHash(tt.hash)
+			if (err == nil) != tt.known {
+				t.Fatalf("checkHash(%q) = %v", tt.hash, err)
+			}
+			if !tt.known {
+				return
+			}
+			if ok, err := CheckPassword(tt.hash, "secret"); !ok || err != nil {
+				t.Errorf("CheckPassword(secret) = %v, %v", ok, err)
+			}
+			if ok, err := CheckPassword(tt.hash, "wrong"); ok || err != nil {
+				t.Errorf("CheckPassword(wrong) = %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestHtpasswdLoad(t *testing.T) {
+	hash, err := HashPassword(HashBcrypt, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"valid", "# users\n\nalice:" + hash + "\n", ""},
+		{"malformed line", "alice:" + hash + "\nbob\n", ":2: malformed line"},
+		{"apr1 hash", "alice:" + hash + "\n\nbob:$apr1$abc$def\n", `:3: user "bob": ` + ErrUnknownHash.Error()},
+		{"cleartext", "alice:secret\n", `:1: user "alice": ` + ErrUnknownHash.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "htpasswd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "users")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := NewHtpasswdStore(path)
+			if tt.err != "" {
+				if err == nil || err.Error() != path+tt.err {
+					t.Fatalf("err = %v, want %s", err, path+tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				user, password string
+				ok             bool
+			}{{"alice", "secret", true}, {"alice", "wrong", false}, {"bob", "secret", false}} {
+				if ok, err := s.Authenticate(c.user, c.password); ok != c.ok || err != nil {
+					t.Errorf("Authenticate(%s, %s) = %v, %v", c.user, c.password, ok, err)
+				}
+			}
+			if dummyHash == "" {
+				t.Error("unknown user refused without hashing")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/mileusna/spf"
+)
+
+// AuthResults builds an Authentication-Results field (RFC 8601) with our
+// ServerName as authserv-id. The same value is used as the payload of the
+// ARC-Authentication-Results field.
+type AuthResults struct {
+	servID  string
+	results []authres.Result
+}
+
+func NewAuthResults(servID string) *AuthResults {
+	return &AuthResults{servID: servID}
+}
+
+func (a *AuthResults) add(r authres.Result) *AuthResults {
+	a.results = append(a.results, r)
+	return a
+}
+
+// SPF adds the result for the MAIL FROM identity.
+func (a *AuthResults) SPF(r spf.Result, mailfrom string) *AuthResults {
+	if !r.IsSet() {
+		return a
+	}
+	return a.add(&authres.SPFResult{Value: spfValue(r), From: mailfrom})
+}
+
+// HELO adds the SPF result for the HELO identity.
+func (a *AuthResults) HELO(r spf.Result, helo string) *AuthResults {
+	if !r.IsSet() {
+		return a
+	}
+	return a.add(&authres.SPFResult{Value: spfValue(r), Helo: helo})
+}
+
+func (a *AuthResults) DKIM(results []DKIMResult) *AuthResults {
+	for _, r := range results {
+		res := &authres.DKIMResult{
+			Value:      authres.ResultValue(r.Result),
+			Domain:     r.Domain,
+			Identifier: r.Identifier,
+		}
+		if r.Err != nil {
+			res.Reason = oneLine(r.Err.Error())
+		}
+		a.add(res)
+	}
+	return a
+}
+
+func (a *AuthResults) DMARC(r *DMARCResult) *AuthResults {
+	if r == nil {
+		return a
+	}
+	res := &authres.DMARCResult{Value: authres.ResultValue(r.Result), From: r.Domain}
+	if r.Result == "fail" {
+		res.Reason = "p=" + string(r.Policy)
+	}
+	return a.add(res)
+}
+
+func (a *AuthResults) ARC(r ARCResult) *AuthResults {
+	if r == "" {
+		return a
+	}
+	return a.add(&authres.GenericResult{Method: "arc", Value: authres.ResultValue(r)})
+}
+
+func (a *AuthResults) IPRev(r authres.ResultValue, ip string) *AuthResults {
+	if r == "" {
+		return a
+	}
+	return a.add(&authres.IPRevResult{Value: r, IP: ip})
+}
+
+// String returns the field value, one method per line.
+func (a *AuthResults) String() string {
+	if len(a.results) == 0 {
+		return a.servID + "; none"
+	}
+
+	list := []string{a.servID}
+	for _, r := range a.results {
+		s := authres.Format("", []authres.Result{r})
+		list = append(list, strings.TrimSpace(strings.TrimPrefix(s, ";")))
+	}
+	return strings.Join(list, ";\r\n\t")
+}
+
+func (a *AuthResults) Header() string {
+	return "Authentication-Results: " + a.String() + "\r\n"
+}
+
+func spfValue(r spf.Result) authres.ResultValue {
+	return authres.ResultValue(strings.ToLower(r.String()))
+}
+
+var comment = regexp.MustCompile(`\([^)]*\)`)
+
+// authServID returns the authserv-id of an Authentication-Results value.
+func authServID(value string) string {
+	v := comment.ReplaceAllString(value, " ")
+	if l := strings.IndexByte(v, ';'); l >= 0 {
+		v = v[:l]
+	}
+	if f := strings.Fields(v); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
+
+// StripAuthResults removes the Authentication-Results fields claiming to
+// come from servID, which can only be forged as we add ours on the way
+// out. It returns the message and the number of fields removed.
+func StripAuthResults(msg []byte, servID string) ([]byte, int) {
+	fields, body := splitMessage(msg)
+
+	removed := 0
+	out := new(bytes.Buffer)
+	for _, f := range fields {
+		if strings.EqualFold(fieldName(f), "Authentication-Results") && strings.EqualFold(authServID(fieldValue(f)), servID) {
+			removed++
+			continue
+		}
+		out.WriteString(f)
+	}
+	if removed == 0 {
+		return msg, 0
+	}
+
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes(), removed
+}
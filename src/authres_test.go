@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/mileusna/spf"
+)
+
+func TestAuthResults(t *testing.T) {
+	tests := []struct {
+		name string
+		a    *AuthResults
+		want string
+	}{
+		{"none", NewAuthResults("mx.example.jp"), "mx.example.jp; none"},
+		{"unset spf", NewAuthResults("mx.example.jp").SPF(spf.Result(""), "a@example.com"), "mx.example.jp; none"},
+		{"all", NewAuthResults("mx.example.jp").
+			SPF(spf.Pass, "a@example.com").
+			HELO(spf.None, "client.example.com").
+			DKIM([]DKIMResult{{Domain: "example.com", Result: "fail", Err: errors.New("bad\r\n signature")}}).
+			DMARC(&DMARCResult{Domain: "example.com", Result: "fail", Policy: "reject"}).
+			ARC(ARCPass).
+			IPRev(authres.ResultPass, "192.0.2.1"),
+			"mx.example.jp;\r\n" +
+				"\tspf=pass smtp.mailfrom=a@example.com;\r\n" +
+				"\tspf=none smtp.helo=client.example.com;\r\n" +
+				"\tdkim=fail reason=\"bad signature\" header.d=example.com;\r\n" +
+				"\tdmarc=fail reason=\"p=reject\" header.from=example.com;\r\n" +
+				"\tarc=pass;\r\n" +
+				"\tiprev=pass policy.iprev=192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.String(); got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+			// Our own output must parse back as RFC 8601.
+			id, results, err := authres.Parse(strings.ReplaceAll(tt.a.String(), "\r\n\t", " "))
+			if err != nil || id != "mx.example.jp" || len(results) != len(tt.a.results) {
+				t.Errorf("Parse = %q, %d results, %v", id, len(results), err)
+			}
+		})
+	}
+}
+
+func TestStripAuthResults(t *testing.T) {
+	msg := "Authentication-Results: MX.example.jp; spf=pass\r\n" +
+		"Received: from client\r\n" +
+		"Authentication-Results: (forged) mx.example.jp;\r\n\tdkim=pass header.d=example.com\r\n" +
+		"Authentication-Results: mx.example.jp.evil; spf=pass\r\n" +
+		"Authentication-Results: other.example; dkim=pass\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.jp; body\r\n"
+
+	got, n := StripAuthResults([]byte(msg), "mx.example.jp")
+	want := "Received: from client\r\n" +
+		"Authentication-Results: mx.example.jp.evil; spf=pass\r\n" +
+		"Authentication-Results: other.example; dkim=pass\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.jp; body\r\n"
+	if n != 2 || string(got) != want {
+		t.Errorf("StripAuthResults = %d\n%s", n, got)
+	}
+
+	clean := "Subject: hi\r\n\r\nbody\r\n"
+	if got, n := StripAuthResults([]byte(clean), "mx.example.jp"); n != 0 || string(got) != clean {
+		t.Errorf("clean message changed: %d %q", n, got)
+	}
+}
@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
@@ -25,7 +30,16 @@ type Backend struct {
 	LMTP      bool
 	Host      string
 	Config    *Config
+	Spool     *Spool
 
+	current    atomic.Value
+	healthMu   sync.Mutex
+	health     map[string]*upstreamState
+	connMu     sync.Mutex
+	conns      map[string]*connPool
+	rateMu     sync.Mutex
+	rates      map[string]*clientRate
+	ratesSwept time.Time
 	unexported struct{}
 }
 
@@ -33,6 +47,11 @@ func New(addr string, conf *Config) *Backend {
 	return &Backend{Addr: addr, Security: SecurityStartTLS, Config: conf}
 }
 
+// NewBackend creates a Backend that forwards to the upstream pools of conf.
+func NewBackend(conf *Config) *Backend {
+	return &Backend{Config: conf}
+}
+
 func NewTLS(addr string, tlsConfig *tls.Config) *Backend {
 	return &Backend{
 		Addr:      addr,
@@ -50,30 +69,242 @@ func NewLMTP(addr string, host string) *Backend {
 	}
 }
 
+// CurrentConfig returns the config new sessions start with.
+func (be *Backend) CurrentConfig() *Config {
+	if c, ok := be.current.Load().(*Config); ok {
+		return c
+	}
+	return be.Config
+}
+
+// Reload validates conf and makes it the config of new sessions. Sessions
+// already in flight keep the snapshot they were started with. On error the
+// current config stays in place.
+func (be *Backend) Reload(conf *Config) error {
+	if err := conf.Validate(); err != nil {
+		log.Println("[reload] rejected:", err)
+		return err
+	}
+
+	if old := be.CurrentConfig(); old != nil {
+		for _, c := range listenerChanges(old.Listeners, conf.Listeners) {
+			log.Println("[reload]", c, "requires restart")
+		}
+	}
+
+	be.current.Store(conf)
+	be.flushConns()
+	log.Println("[reload] ok")
+	return nil
+}
+
+// listenerChanges describes how the listeners b differ from a. Listeners
+// are bound with their settings at startup, so none of these changes
+// applies before a restart.
+func listenerChanges(a, b []Listener) []string {
+	if len(a) != len(b) {
+		return []string{"listener list change"}
+	}
+	var changes []string
+	for n := range a {
+		if a[n].Address() != b[n].Address() || a[n].Role != b[n].Role {
+			changes = append(changes, fmt.Sprintf("listener %s change", a[n].Address()))
+			continue
+		}
+		if a[n].MaxMessageBytes != b[n].MaxMessageBytes {
+			changes = append(changes, fmt.Sprintf("listener %s max message bytes change", a[n].Address()))
+		}
+		if !sameMilters(a[n].Milters, b[n].Milters) {
+			changes = append(changes, fmt.Sprintf("listener %s milters change", a[n].Address()))
+		}
+		if !sameCertificates(a[n].TlsConfig, b[n].TlsConfig) {
+			changes = append(changes, fmt.Sprintf("listener %s TLS certificate change", a[n].Address()))
+		}
+	}
+	return changes
+}
+
+func sameMilters(a, b []MilterSetting) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameCertificates(a, b *tls.Config) bool {
+	var ca, cb []tls.Certificate
+	if a != nil {
+		ca = a.Certificates
+	}
+	if b != nil {
+		cb = b.Certificates
+	}
+	if len(ca) != len(cb) {
+		return false
+	}
+	for n := range ca {
+		if len(ca[n].Certificate) != len(cb[n].Certificate) {
+			return false
+		}
+		for i := range ca[n].Certificate {
+			if !bytes.Equal(ca[n].Certificate[i], cb[n].Certificate[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newConn connects to the first reachable upstream of the default pool.
 func (be *Backend) newConn() (*smtp.Client, error) {
+	conf := be.CurrentConfig()
+	list, err := be.pool(conf, "")
+	if err != nil {
+		return nil, err
+	}
+
+	h := conf.Health.orDefault()
+	for _, up := range be.candidates(list) {
+		var c *smtp.Client
+		c, err = dial(up)
+		if err == nil {
+			return c, nil
+		}
+		be.markFailure(h, up, err)
+		log.Println("[upstream]", up.Addr, "failed, trying next:", err)
+	}
+	return nil, err
+}
+
+// rcptError hides the upstream's reply to RCPT from the client while
+// keeping it available to errors.As.
+type rcptError struct {
+	err error
+}
+
+func (e *rcptError) Error() string {
+	return "Server Error"
+}
+
+func (e *rcptError) Unwrap() error {
+	return e.err
+}
+
+// deliver sends a composed message through the named upstream pool of
+// conf. A connect error or a 4xx reply moves on to the next upstream, a 5xx
+// reply is returned as is.
+func (be *Backend) deliver(conf *Config, upstream, envelope string, dests []string, opts *smtp.MailOptions, msg []byte) error {
+	list, err := be.pool(conf, upstream)
+	if err != nil {
+		return err
+	}
+
+	h := conf.Health.orDefault()
+	cs := conf.ConnPool.orDefault()
+	for _, up := range be.candidates(list) {
+		err = be.deliverTo(cs, up, envelope, dests, opts, msg)
+		if err == nil || permanentError(err) {
+			be.markSuccess(up)
+			return err
+		}
+		be.markFailure(h, up, err)
+		log.Println("[upstream]", up.Addr, "failed, trying next:", err)
+	}
+	return err
+}
+
+// deliverTo runs one transaction on a pooled connection. The connection
+// goes back to the pool when the upstream answered, even with an error
+// reply; anything else means it is broken and it is closed.
+func (be *Backend) deliverTo(cs ConnPoolSetting, up Upstream, envelope string, dests []string, opts *smtp.MailOptions, msg []byte) error {
+	pc, err := be.getConn(cs, up)
+	if err != nil {
+		return err
+	}
+
+	err = send(pc.c, envelope, dests, opts, msg)
+	if _, ok := asSMTPError(err); err == nil || ok {
+		be.putConn(cs, up, pc)
+	} else {
+		pc.c.Close()
+	}
+	return err
+}
+
+func send(conn *smtp.Client, envelope string, dests []string, opts *smtp.MailOptions, msg []byte) error {
+	if opts != nil && opts.UTF8 {
+		if ok, _ := conn.Extension("SMTPUTF8"); !ok {
+			var err error
+			if msg, err = downgrade(envelope, dests, msg); err != nil {
+				return err
+			}
+			o := *opts
+			o.UTF8 = false
+			opts = &o
+		}
+	}
+
+	err := conn.Mail(envelope, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dests {
+		if err := conn.Rcpt(d); err != nil {
+			log.Println("[upstream] RCPT", d, err)
+			return &rcptError{err}
+		}
+	}
+
+	wc, err := conn.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = wc.Write(msg); err != nil {
+		log.Println("data Coping error:", err)
+
+		wc.Close()
+		return err
+	}
+
+	err = wc.Close()
+	if err != nil {
+		log.Println("data Closing error:", err)
+		return err
+	}
+	return nil
+}
+
+func dial(up Upstream) (*smtp.Client, error) {
 	var conn net.Conn
 	var err error
-	if be.LMTP {
-		if be.Security != SecurityNone {
+	if up.LMTP {
+		if up.Security != SecurityNone {
 			return nil, errors.New("smtp-proxy: LMTP doesn't support TLS")
 		}
-		conn, err = net.Dial("unix", be.Addr)
-	} else if be.Security == SecurityTLS {
-		conn, err = tls.Dial("tcp", be.Addr, be.TLSConfig)
+		conn, err = net.Dial("unix", up.Addr)
+	} else if up.Security == SecurityTLS {
+		conn, err = tls.Dial("tcp", up.Addr, up.TLSConfig)
 	} else {
-		conn, err = net.Dial("tcp", be.Addr)
+		conn, err = net.Dial("tcp", up.Addr)
 	}
 	if err != nil {
 		return nil, err
 	}
 
 	var c *smtp.Client
-	if be.LMTP {
-		c, err = smtp.NewClientLMTP(conn, be.Host)
+	if up.LMTP {
+		c, err = smtp.NewClientLMTP(conn, up.Host)
 	} else {
-		host := be.Host
+		host := up.Host
 		if host == "" {
-			host, _, _ = net.SplitHostPort(be.Addr)
+			host, _, _ = net.SplitHostPort(up.Addr)
 		}
 		c, err = smtp.NewClient(conn, host)
 	}
@@ -81,8 +312,8 @@ func (be *Backend) newConn() (*smtp.Client, error) {
 		return nil, err
 	}
 
-	if be.Security == SecurityStartTLS {
-		if err := c.StartTLS(be.TLSConfig); err != nil {
+	if up.Security == SecurityStartTLS {
+		if err := c.StartTLS(up.TLSConfig); err != nil {
 			return nil, err
 		}
 	}
@@ -92,24 +323,49 @@ func (be *Backend) newConn() (*smtp.Client, error) {
 
 func (be *Backend) Login(ctx context.Context, state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
 	log.Println("[login]", username, "from", state.RemoteAddr)
-	ctx = SetConfig(ctx, be.Config)
+	conf := be.CurrentConfig()
+	ctx = SetConfig(ctx, conf)
 
-	for _, usr := range be.Config.Users {
-		if usr.Name == username && usr.PlainPassword == password {
-			log.Println("[login] success")
-			return &sender2{
-				st:  state,
-				ctx: ctx,
-			}, nil
-		}
+	users := conf.UserStore
+	if users == nil {
+		users = userList(conf.Users)
 	}
 
-	return nil, errors.New("Invalid username or password")
+	if lockedOut(conf.Lockout.orDefault(), state, username) {
+		return nil, NewAuthTempError()
+	}
+
+	ok, err := users.Authenticate(username, password)
+	if err != nil {
+		log.Println("[login] error:", err)
+		return nil, NewAuthTempError()
+	}
+	if !ok {
+		log.Println("[login] failed", username, "from", state.RemoteAddr)
+		loginFailed(conf.Lockout.orDefault(), state, username)
+		return nil, NewAuthFailedError()
+	}
+
+	log.Println("[login] success")
+	loginSucceeded(state, username)
+
+	s := &sender2{
+		user: username,
+		st:   state,
+		ctx:  ctx,
+	}
+	if l, ok := FindListener(ctx); ok {
+		if s.milter, err = openMilters(l.Milters, conf, state); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (be *Backend) AnonymousLogin(ctx context.Context, state *smtp.ConnectionState) (smtp.Session, error) {
 	log.Println("[AnonymousLogin] HELO", state.Hostname)
-	ctx = SetConfig(ctx, be.Config)
+	conf := be.CurrentConfig()
+	ctx = SetConfig(ctx, conf)
 
 	s := &session2{
 		be:  be,
@@ -117,5 +373,40 @@ func (be *Backend) AnonymousLogin(ctx context.Context, state *smtp.ConnectionSta
 		ctx: ctx,
 	}
 
+	if l, ok := FindListener(ctx); ok {
+		var err error
+		if s.milter, err = openMilters(l.Milters, conf, state); err != nil {
+			return nil, err
+		}
+	}
+
 	return s, nil
 }
+
+// ListenerBackend restricts a Backend to the session type allowed by the
+// listener's role: RoleMX only accepts anonymous inbound sessions, the
+// submission roles only accept authenticated ones.
+type ListenerBackend struct {
+	*Backend
+	Listener Listener
+}
+
+func (be *Backend) ForListener(l Listener) *ListenerBackend {
+	return &ListenerBackend{Backend: be, Listener: l}
+}
+
+func (lb *ListenerBackend) Login(ctx context.Context, state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if lb.Listener.Role == RoleMX {
+		log.Println("[login] refused on", lb.Listener.Role, "listener from", state.RemoteAddr)
+		return nil, smtp.ErrAuthUnsupported
+	}
+	return lb.Backend.Login(SetListener(ctx, &lb.Listener), state, username, password)
+}
+
+func (lb *ListenerBackend) AnonymousLogin(ctx context.Context, state *smtp.ConnectionState) (smtp.Session, error) {
+	if lb.Listener.Role != RoleMX {
+		log.Println("[AnonymousLogin] refused on", lb.Listener.Role, "listener from", state.RemoteAddr)
+		return nil, smtp.ErrAuthRequired
+	}
+	return lb.Backend.AnonymousLogin(SetListener(ctx, &lb.Listener), state)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestListenerChanges(t *testing.T) {
+	cert := func(der string) *tls.Config {
+		return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{[]byte(der)}}}}
+	}
+	mx := Listener{Addr: "0.0.0.0", Port: 25, Role: RoleMX, MaxMessageBytes: 1000, TlsConfig: cert("a"),
+		Milters: []MilterSetting{{Name: "spam", Network: "tcp", Address: "127.0.0.1:8891"}}}
+
+	tests := []struct {
+		name   string
+		change func(l *Listener)
+		want   []string
+	}{
+		{"same", func(l *Listener) { l.TlsConfig = cert("a") }, nil},
+		{"port", func(l *Listener) { l.Port = 2525 }, []string{"listener 0.0.0.0:25 change"}},
+		{"size", func(l *Listener) { l.MaxMessageBytes = 2000 }, []string{"listener 0.0.0.0:25 max message bytes change"}},
+		{"milter", func(l *Listener) {
+			l.Milters = []MilterSetting{{Name: "spam", Network: "unix", Address: "/run/milter"}}
+		}, []string{"listener 0.0.0.0:25 milters change"}},
+		{"certificate", func(l *Listener) { l.TlsConfig = cert("b") }, []string{"listener 0.0.0.0:25 TLS certificate change"}},
+		{"no TLS", func(l *Listener) { l.TlsConfig = nil }, []string{"listener 0.0.0.0:25 TLS certificate change"}},
+	}
+	for _, tt := range tests {
+		l := mx
+		tt.change(&l)
+		if got := listenerChanges([]Listener{mx}, []Listener{l}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changes = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := listenerChanges([]Listener{mx}, nil); len(got) != 1 {
+		t.Errorf("removed listener: changes = %q", got)
+	}
+}
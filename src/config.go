@@ -3,9 +3,15 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
 )
 
-const ConfigKey string = "_config"
+const (
+	ConfigKey   string = "_config"
+	ListenerKey string = "_listener"
+)
 
 func SetConfig(ctx context.Context, conf *Config) context.Context {
 	return context.WithValue(ctx, ConfigKey, conf)
@@ -19,37 +25,144 @@ func GetConfig(ctx context.Context) *Config {
 	return c
 }
 
+func SetListener(ctx context.Context, l *Listener) context.Context {
+	return context.WithValue(ctx, ListenerKey, l)
+}
+
+// FindListener returns the listener a session came in on, if any.
+func FindListener(ctx context.Context) (*Listener, bool) {
+	l, ok := ctx.Value(ListenerKey).(*Listener)
+	return l, ok
+}
+
 type Config struct {
 	Name          string
 	ServerName    string
 	Users         []User
-	Listeners     Listener
+	UserStore     UserStore
+	Lockout       LockoutSetting
+	Spool         SpoolSetting
+	Listeners     []Listener
 	ListenDomains []ListenDomain
+	Upstream      []Upstream
+	Upstreams     map[string][]Upstream
+	Health        HealthSetting
+	ConnPool      ConnPoolSetting
 	ProxyAddress  string
 	ProxyEnvelope string
+	SRS           SRSSetting
 	Allocation    AllocationSetting
 	FromName      string
 	DkimSelector  string
 	DkimPrivate   string
 	DkimDomain    string
+	SPF           SPFSetting
+	Greylist      GreylistSetting
+	RateLimit     RateLimitSetting
+	DKIMVerify    DKIMVerifySetting
+	DMARC         DMARCSetting
+	Spam          SpamSetting
+	Virus         VirusSetting
+	// QuarantineTo receives quarantined mail instead of its destinations.
+	// Without it quarantined mail is only marked with X-Quarantine.
+	QuarantineTo string
+}
+
+// Validate checks a config before it is put in service, either at startup
+// or on reload, with the rules LoadConfig applies.
+func (c *Config) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	l := &configLoader{file: "config"}
+	c.validate(l)
+	if len(l.errs) > 0 {
+		return l.errs
+	}
+	return nil
 }
 
 type AllocationSetting struct {
 	ToAddresses    map[string]bool
 	ToDomains      map[string]bool
 	BlacklistHosts map[string]bool
+	Routes         []Route
+}
+
+// Route maps recipients matching Pattern (an address, a domain, "*@domain",
+// "*.domain" or "*") to the addresses the message is forwarded to.
+// Destinations defaults to Config.ProxyAddress, Upstream to Config.Upstream
+// and Envelope to Config.ProxyEnvelope.
+type Route struct {
+	Pattern      string
+	Destinations []string
+	Upstream     string
+	Envelope     string
 }
 
 type User struct {
 	Name          string
 	PlainPassword string
+	// Password is a bcrypt or argon2id hash, see HashPassword.
+	Password string
+	// AllowedFrom lists the addresses and domains the user may use as
+	// envelope and header From. Empty means unrestricted.
+	AllowedFrom []string
+	// MaxMessageBytes lowers the size limit of the listener for this user,
+	// zero keeps it.
+	MaxMessageBytes int
+}
+
+type Role int
+
+const (
+	// RoleMX accepts anonymous inbound mail only.
+	RoleMX Role = iota
+	// RoleSubmission requires AUTH after STARTTLS.
+	RoleSubmission
+	// RoleSubmissions requires AUTH over implicit TLS.
+	RoleSubmissions
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleMX:
+		return "mx"
+	case RoleSubmission:
+		return "submission"
+	case RoleSubmissions:
+		return "submissions"
+	}
+	return "unknown"
 }
 
 type Listener struct {
+	Addr         string
 	Port         int
+	Role         Role
 	TlsConfig    *tls.Config
 	ReadTimeout  int
 	WriteTimeout int
+	// MaxMessageBytes is advertised as SIZE, zero means unlimited.
+	MaxMessageBytes int
+	// Milters see every session on the listener, in order.
+	Milters []MilterSetting
+}
+
+type Upstream struct {
+	Addr      string
+	Security  Security
+	TLSConfig *tls.Config
+	LMTP      bool
+	Host      string
+	// Priority orders upstreams, lowest first. Weight spreads deliveries
+	// between upstreams of the same priority.
+	Priority int
+	Weight   int
+}
+
+func (l Listener) Address() string {
+	return net.JoinHostPort(l.Addr, strconv.Itoa(l.Port))
 }
 
 type DKIMSetting struct {
@@ -58,4 +171,26 @@ type DKIMSetting struct {
 	Selector       string
 }
 
+// DKIMVerifySetting lists the domains whose mail must carry a valid DKIM
+// signature, and what happens to their mail when it doesn't.
+type DKIMVerifySetting struct {
+	MustSign map[string]bool
+	Policy   PolicyAction
+}
+
+// PolicyAction is what happens to a message failing a check.
+type PolicyAction string
+
+const (
+	ActionAccept PolicyAction = "accept"
+	ActionTag    PolicyAction = "tag"
+	ActionReject PolicyAction = "reject"
+	// ActionTempfail answers with a 4xx so the client retries later.
+	ActionTempfail PolicyAction = "tempfail"
+	// ActionQuarantine sends the message to Config.QuarantineTo.
+	ActionQuarantine PolicyAction = "quarantine"
+	// ActionStrip removes the offending parts of the message.
+	ActionStrip PolicyAction = "strip"
+)
+
 type ListenDomain string
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type ConnPoolSetting struct {
+	// MaxIdle idle connections are kept per upstream, a negative value
+	// disables reuse.
+	MaxIdle int
+	// Connections are closed once older than MaxAge or idle for longer
+	// than IdleTimeout.
+	MaxAge      time.Duration
+	IdleTimeout time.Duration
+}
+
+var DefaultConnPool = ConnPoolSetting{
+	MaxIdle:     4,
+	MaxAge:      5 * time.Minute,
+	IdleTimeout: 30 * time.Second,
+}
+
+func (s ConnPoolSetting) orDefault() ConnPoolSetting {
+	if s == (ConnPoolSetting{}) {
+		return DefaultConnPool
+	}
+	return s
+}
+
+type PoolStats struct {
+	Addr      string
+	Idle      int
+	Dials     uint64
+	Reuses    uint64
+	Evictions uint64
+}
+
+type pooledConn struct {
+	c       *smtp.Client
+	created time.Time
+	used    time.Time
+}
+
+type connPool struct {
+	idle  []*pooledConn
+	stats PoolStats
+}
+
+// poolKey tells apart the pools of upstreams that share an address but
+// are reached differently. The TLS config is a pointer that changes with
+// every reload, so Reload flushes the pools instead.
+func poolKey(up Upstream) string {
+	return fmt.Sprintf("%s %d %s", upstreamKey(up), up.Security, up.Host)
+}
+
+func (be *Backend) connPool(up Upstream) *connPool {
+	if be.conns == nil {
+		be.conns = map[string]*connPool{}
+	}
+	p, ok := be.conns[poolKey(up)]
+	if !ok {
+		p = &connPool{stats: PoolStats{Addr: upstreamKey(up)}}
+		be.conns[poolKey(up)] = p
+	}
+	return p
+}
+
+func (s ConnPoolSetting) expired(pc *pooledConn, now time.Time) bool {
+	return (s.MaxAge > 0 && now.Sub(pc.created) > s.MaxAge) ||
+		(s.IdleTimeout > 0 && now.Sub(pc.used) > s.IdleTimeout)
+}
+
+// getConn returns an idle connection to up after a successful RSET, or
+// dials a new one. Expired and broken connections are closed on the way.
+func (be *Backend) getConn(s ConnPoolSetting, up Upstream) (*pooledConn, error) {
+	for {
+		be.connMu.Lock()
+		p := be.connPool(up)
+		if len(p.idle) == 0 {
+			be.connMu.Unlock()
+			break
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		be.connMu.Unlock()
+
+		if s.expired(pc, time.Now()) || pc.c.Reset() != nil {
+			be.evict(up, pc)
+			continue
+		}
+
+		be.connMu.Lock()
+		p.stats.Reuses++
+		be.connMu.Unlock()
+		return pc, nil
+	}
+
+	c, err := dial(up)
+	if err != nil {
+		return nil, err
+	}
+
+	be.connMu.Lock()
+	be.connPool(up).stats.Dials++
+	be.connMu.Unlock()
+
+	now := time.Now()
+	return &pooledConn{c: c, created: now, used: now}, nil
+}
+
+// putConn hands a healthy connection back, or quits it when the pool is
+// full or disabled.
+func (be *Backend) putConn(s ConnPoolSetting, up Upstream, pc *pooledConn) {
+	now := time.Now()
+	pc.used = now
+
+	be.connMu.Lock()
+	p := be.connPool(up)
+	evicted := p.expire(s, now)
+	if s.MaxIdle > 0 && len(p.idle) < s.MaxIdle && !s.expired(pc, now) {
+		p.idle = append(p.idle, pc)
+		pc = nil
+	}
+	be.connMu.Unlock()
+
+	for _, old := range evicted {
+		old.c.Quit()
+	}
+	if pc != nil {
+		pc.c.Quit()
+	}
+}
+
+// expire takes the expired connections out of p and counts them as
+// evicted. The caller holds connMu and quits them.
+func (p *connPool) expire(s ConnPoolSetting, now time.Time) []*pooledConn {
+	var evicted []*pooledConn
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if s.expired(pc, now) {
+			evicted = append(evicted, pc)
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	p.idle = kept
+	p.stats.Evictions += uint64(len(evicted))
+	return evicted
+}
+
+// RunPoolReaper quits the idle connections once they expired, until done
+// is closed, so that they aren't left to the upstream's timeout when no
+// delivery comes along.
+func (be *Backend) RunPoolReaper(done <-chan struct{}) {
+	for {
+		wait := be.CurrentConfig().ConnPool.orDefault().reapInterval()
+		if wait <= 0 {
+			wait = disabledPoll
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		if s := be.CurrentConfig().ConnPool.orDefault(); s.reapInterval() > 0 {
+			be.reapConns(s, time.Now())
+		}
+	}
+}
+
+// reapInterval is how often idle connections are looked at, zero when
+// nothing is ever kept idle or nothing expires.
+func (s ConnPoolSetting) reapInterval() time.Duration {
+	if s.MaxIdle <= 0 {
+		return 0
+	}
+	interval := s.IdleTimeout
+	if interval <= 0 || (s.MaxAge > 0 && s.MaxAge < interval) {
+		interval = s.MaxAge
+	}
+	return interval
+}
+
+func (be *Backend) reapConns(s ConnPoolSetting, now time.Time) {
+	var evicted []*pooledConn
+	be.connMu.Lock()
+	for _, p := range be.conns {
+		evicted = append(evicted, p.expire(s, now)...)
+	}
+	be.connMu.Unlock()
+
+	for _, pc := range evicted {
+		pc.c.Quit()
+	}
+}
+
+// flushConns quits every idle connection, so that none dialed with the
+// settings of an older config gets reused.
+func (be *Backend) flushConns() {
+	var idle []*pooledConn
+	be.connMu.Lock()
+	for _, p := range be.conns {
+		idle = append(idle, p.idle...)
+		p.idle = nil
+	}
+	be.connMu.Unlock()
+
+	for _, pc := range idle {
+		pc.c.Quit()
+	}
+}
+
+func (be *Backend) evict(up Upstream, pc *pooledConn) {
+	pc.c.Close()
+
+	be.connMu.Lock()
+	be.connPool(up).stats.Evictions++
+	be.connMu.Unlock()
+}
+
+// PoolStats reports connection reuse per upstream.
+func (be *Backend) PoolStats() []PoolStats {
+	be.connMu.Lock()
+	defer be.connMu.Unlock()
+
+	var list []PoolStats
+	for _, p := range be.conns {
+		st := p.stats
+		st.Idle = len(p.idle)
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
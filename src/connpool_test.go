@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapConns(t *testing.T) {
+	addr, _ := fakeMX(t, "250 ok")
+	up := Upstream{Addr: addr, Security: SecurityNone}
+	s := ConnPoolSetting{MaxIdle: 4, MaxAge: time.Hour, IdleTimeout: time.Minute}
+	be := &Backend{}
+
+	var conns []*pooledConn
+	for i := 0; i < 3; i++ {
+		pc, err := be.getConn(s, up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, pc)
+	}
+	for _, pc := range conns {
+		be.putConn(s, up, pc)
+	}
+
+	now := time.Now()
+	conns[0].used = now.Add(-2 * time.Minute)
+	conns[1].created = now.Add(-2 * time.Hour)
+	be.reapConns(s, now)
+
+	st := be.PoolStats()
+	if len(st) != 1 || st[0].Addr != upstreamKey(up) || st[0].Idle != 1 || st[0].Dials != 3 || st[0].Evictions != 2 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	pc, err := be.getConn(s, up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc != conns[2] {
+		t.Error("the connection left in the pool wasn't reused")
+	}
+	if st := be.PoolStats(); st[0].Reuses != 1 || st[0].Idle != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+	pc.c.Close()
+}
+
+func TestPoolKey(t *testing.T) {
+	addr, _ := fakeMX(t, "250 ok")
+	s := ConnPoolSetting{MaxIdle: 4, MaxAge: time.Hour, IdleTimeout: time.Minute}
+	_, conf, err := loadTestConfig(t, "c.yaml", baseYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := NewBackend(conf)
+
+	a := Upstream{Addr: addr, Security: SecurityNone}
+	b := Upstream{Addr: addr, Security: SecurityNone, Host: "other.example"}
+	pc, err := be.getConn(s, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.putConn(s, a, pc)
+	if len(be.connPool(b).idle) != 0 {
+		t.Fatal("connection shared between upstreams with a different host")
+	}
+
+	next := *conf
+	if err := be.Reload(&next); err != nil {
+		t.Fatal(err)
+	}
+	if len(be.connPool(a).idle) != 0 {
+		t.Error("idle connection kept across a reload")
+	}
+}
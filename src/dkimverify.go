@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimMaxVerifications bounds the work a message with many signatures can
+// cause.
+const dkimMaxVerifications = 8
+
+// DKIMResult is the outcome of verifying one DKIM-Signature. Result is one
+// of pass, fail, temperror or permerror as in RFC 8601.
+type DKIMResult struct {
+	Domain     string
+	Identifier string
+	Result     string
+	Err        error
+}
+
+func (r DKIMResult) String() string {
+	s := fmt.Sprintf("dkim=%s header.d=%s", r.Result, r.Domain)
+	if r.Identifier != "" {
+		s += " header.i=" + r.Identifier
+	}
+	if r.Err != nil {
+		s += " (" + oneLine(r.Err.Error()) + ")"
+	}
+	return s
+}
+
+// VerifyDKIM checks every DKIM-Signature of msg. A message without
+// signatures gives no results.
+func VerifyDKIM(msg []byte) ([]DKIMResult, error) {
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT:        lookupTXT,
+		MaxVerifications: dkimMaxVerifications,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return nil, err
+	}
+
+	var results []DKIMResult
+	for _, v := range verifs {
+		r := DKIMResult{Domain: v.Domain, Identifier: v.Identifier, Result: "pass", Err: v.Err}
+		switch {
+		case v.Err == nil:
+		case dkim.IsTempFail(v.Err):
+			r.Result = "temperror"
+		case dkim.IsPermFail(v.Err):
+			r.Result = "permerror"
+		default:
+			r.Result = "fail"
+		}
+		results = append(results, r)
+	}
+	return results, err
+}
+
+// mustSign returns the listed domain the author domain falls under, if
+// any.
+func (s DKIMVerifySetting) mustSign(domain string) (string, bool) {
+	domain = normalizeHost(domain)
+	for d := domain; d != ""; {
+		if s.MustSign[d] {
+			return d, true
+		}
+		l := strings.IndexByte(d, '.')
+		if l < 0 {
+			break
+		}
+		d = d[l+1:]
+	}
+	return "", false
+}
+
+// dkimSigned reports whether one of results is a pass from domain or one of
+// its subdomains.
+func dkimSigned(results []DKIMResult, domain string) bool {
+	for _, r := range results {
+		d := strings.ToLower(r.Domain)
+		if r.Result == "pass" && (d == domain || strings.HasSuffix(d, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFrom returns the address in the From field of msg.
+func headerFrom(msg []byte) string {
+	fields, _ := splitMessage(msg)
+	for _, f := range fields {
+		if strings.EqualFold(fieldName(f), "From") {
+			return ParseAddress(strings.TrimSpace(fieldValue(f)))
+		}
+	}
+	return ""
+}
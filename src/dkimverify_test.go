@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func dkimSign(t *testing.T, msg, domain string) string {
+	var b bytes.Buffer
+	err := dkim.Sign(&b, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "test",
+		Signer:   signingKey(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	testSigner(t)
+	signed := dkimSign(t, testMessage, "example.org")
+	unknown := dkimSign(t, testMessage, "unknown.example")
+
+	tests := []struct {
+		name    string
+		msg     string
+		results []string
+	}{
+		{"unsigned", testMessage, nil},
+		{"signed", signed, []string{"pass"}},
+		{"body changed", strings.Replace(signed, "see you.", "send money.", 1), []string{"fail"}},
+		{"signed header changed", strings.Replace(signed, "Subject: hello", "Subject: win", 1), []string{"fail"}},
+		{"no key", unknown, []string{"permerror"}},
+		{"two signatures", dkimSign(t, signed, "unknown.example"), []string{"permerror", "pass"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := VerifyDKIM([]byte(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Result)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.results, ",") {
+				t.Errorf("results = %v, want %v", results, tt.results)
+			}
+		})
+	}
+}
+
+func TestVerifyDKIMTooManySignatures(t *testing.T) {
+	testSigner(t)
+	msg := testMessage
+	for i := 0; i <= dkimMaxVerifications; i++ {
+		msg = dkimSign(t, msg, "example.org")
+	}
+	results, err := VerifyDKIM([]byte(msg))
+	if err != dkim.ErrTooManySignatures {
+		t.Errorf("err = %v, want %v", err, dkim.ErrTooManySignatures)
+	}
+	if len(results) != dkimMaxVerifications {
+		t.Errorf("%d results, want %d", len(results), dkimMaxVerifications)
+	}
+}
+
+func TestDKIMMustSign(t *testing.T) {
+	s := DKIMVerifySetting{MustSign: map[string]bool{"example.org": true}}
+	tests := []struct {
+		domain string
+		listed string
+		ok     bool
+	}{
+		{"example.org", "example.org", true},
+		{"EXAMPLE.org", "example.org", true},
+		{"mail.example.org", "example.org", true},
+		{"badexample.org", "", false},
+		{"example.net", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		listed, ok := s.mustSign(tt.domain)
+		if listed != tt.listed || ok != tt.ok {
+			t.Errorf("mustSign(%q) = %q, %v, want %q, %v", tt.domain, listed, ok, tt.listed, tt.ok)
+		}
+	}
+}
+
+func TestDKIMSigned(t *testing.T) {
+	results := []DKIMResult{
+		{Domain: "Mail.Example.org", Result: "pass"},
+		{Domain: "example.net", Result: "fail"},
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.org", true},
+		{"mail.example.org", true},
+		{"example.net", false},
+		{"ample.org", false},
+	}
+	for _, tt := range tests {
+		if got := dkimSigned(results, tt.domain); got != tt.want {
+			t.Errorf("dkimSigned(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/mileusna/spf"
+	"golang.org/x/net/publicsuffix"
+)
+
+type DMARCSetting struct {
+	Enabled bool
+}
+
+// DMARCResult is the DMARC evaluation of one message. Result is one of
+// pass, fail, none, temperror or permerror, Policy the disposition the
+// domain asks for after pct sampling.
+type DMARCResult struct {
+	Domain string
+	Result string
+	Policy dmarc.Policy
+}
+
+func (r DMARCResult) String() string {
+	s := "dmarc=" + r.Result
+	if r.Result == "fail" {
+		s += " (p=" + string(r.Policy) + ")"
+	}
+	return s + " header.from=" + r.Domain
+}
+
+// EvaluateDMARC checks the author domain against the SPF and DKIM results
+// (RFC 7489). spfDomain is the MAIL FROM domain, or the HELO name for the
+// null sender.
+func EvaluateDMARC(fromDomain string, spfResult spf.Result, spfDomain string, dkims []DKIMResult) DMARCResult {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	r := DMARCResult{Domain: fromDomain, Result: "none", Policy: dmarc.PolicyNone}
+	if fromDomain == "" {
+		return r
+	}
+
+	org := orgDomain(fromDomain)
+	rec, err := dmarc.LookupWithOptions(fromDomain, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+	inherited := false
+	if err == dmarc.ErrNoPolicy && org != fromDomain {
+		rec, err = dmarc.LookupWithOptions(org, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+		inherited = true
+	}
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		return r
+	case dmarc.IsTempFail(err):
+		r.Result = "temperror"
+		return r
+	case err != nil:
+		r.Result = "permerror"
+		return r
+	}
+
+	if spfResult == spf.Pass && aligned(fromDomain, spfDomain, rec.SPFAlignment) {
+		r.Result = "pass"
+		return r
+	}
+	for _, d := range dkims {
+		if d.Result == "pass" && aligned(fromDomain, d.Domain, rec.DKIMAlignment) {
+			r.Result = "pass"
+			return r
+		}
+	}
+
+	r.Result = "fail"
+	r.Policy = rec.Policy
+	if inherited && rec.SubdomainPolicy != "" {
+		r.Policy = rec.SubdomainPolicy
+	}
+
+	// Messages outside the pct sample get the next less strict policy.
+	if rec.Percent != nil && rand.Intn(100) >= *rec.Percent {
+		switch r.Policy {
+		case dmarc.PolicyReject:
+			r.Policy = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			r.Policy = dmarc.PolicyNone
+		}
+	}
+	return r
+}
+
+func aligned(fromDomain, domain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+// orgDomain returns the organizational domain, the registered domain below
+// the public suffix.
+func orgDomain(domain string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
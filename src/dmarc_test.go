@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/mileusna/spf"
+)
+
+func TestEvaluateDMARC(t *testing.T) {
+	useFakeTXT(t, map[string]string{
+		"_dmarc.example.org":    "v=DMARC1; p=reject; sp=quarantine",
+		"_dmarc.strict.org":     "v=DMARC1; p=reject; aspf=s; adkim=s",
+		"_dmarc.sampled.org":    "v=DMARC1; p=reject; pct=0",
+		"_dmarc.quarantine.org": "v=DMARC1; p=quarantine; pct=0",
+		"_dmarc.full.org":       "v=DMARC1; p=reject; pct=100",
+		"_dmarc.nosp.org":       "v=DMARC1; p=reject",
+		"_dmarc.broken.org":     "v=DMARC1; p=bogus",
+	})
+	pass := []DKIMResult{{Domain: "mail.example.org", Result: "pass"}}
+	failed := []DKIMResult{{Domain: "example.org", Result: "fail"}}
+
+	tests := []struct {
+		name      string
+		from      string
+		spf       spf.Result
+		spfDomain string
+		dkims     []DKIMResult
+		result    string
+		policy    dmarc.Policy
+	}{
+		{"no record", "example.net", spf.Fail, "example.net", nil, "none", dmarc.PolicyNone},
+		{"no From", "", spf.Pass, "example.org", nil, "none", dmarc.PolicyNone},
+		{"aligned SPF", "example.org", spf.Pass, "bounce.example.org", nil, "pass", dmarc.PolicyNone},
+		{"aligned DKIM", "example.org", spf.Fail, "example.org", pass, "pass", dmarc.PolicyNone},
+		{"SPF pass for another domain", "example.org", spf.Pass, "example.net", nil, "fail", dmarc.PolicyReject},
+		{"DKIM fail", "example.org", spf.None, "", failed, "fail", dmarc.PolicyReject},
+		{"trailing dot and case", "Example.ORG.", spf.Pass, "example.org.", nil, "pass", dmarc.PolicyNone},
+		{"strict SPF subdomain", "strict.org", spf.Pass, "mail.strict.org", nil, "fail", dmarc.PolicyReject},
+		{"strict DKIM subdomain", "strict.org", spf.Fail, "", []DKIMResult{{Domain: "mail.strict.org", Result: "pass"}}, "fail", dmarc.PolicyReject},
+		{"strict exact", "strict.org", spf.Pass, "strict.org", nil, "pass", dmarc.PolicyNone},
+		{"subdomain uses sp", "mail.example.org", spf.Fail, "", nil, "fail", dmarc.PolicyQuarantine},
+		{"subdomain without sp", "mail.nosp.org", spf.Fail, "", nil, "fail", dmarc.PolicyReject},
+		{"pct=0 reject", "sampled.org", spf.Fail, "", nil, "fail", dmarc.PolicyQuarantine},
+		{"pct=0 quarantine", "quarantine.org", spf.Fail, "", nil, "fail", dmarc.PolicyNone},
+		{"pct=100", "full.org", spf.Fail, "", nil, "fail", dmarc.PolicyReject},
+		{"malformed record", "broken.org", spf.Pass, "broken.org", nil, "permerror", dmarc.PolicyNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := EvaluateDMARC(tt.from, tt.spf, tt.spfDomain, tt.dkims)
+			if r.Result != tt.result || r.Policy != tt.policy {
+				t.Errorf("EvaluateDMARC = %s/%s, want %s/%s", r.Result, r.Policy, tt.result, tt.policy)
+			}
+		})
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	tests := []struct {
+		domain, want string
+	}{
+		{"example.org", "example.org"},
+		{"a.b.example.org", "example.org"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"localhost", "localhost"},
+	}
+	for _, tt := range tests {
+		if got := orgDomain(tt.domain); got != tt.want {
+			t.Errorf("orgDomain(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
+	n_smtp "net/smtp"
+	"net/textproto"
 	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
 )
 
 func StripPort(addr net.Addr) string {
@@ -32,6 +37,32 @@ func StripEmail(email string) (string, string) {
 	return email[:l], email[l+1:]
 }
 
+// CheckIPRev is the iprev check of RFC 8601: ip passes when one of its PTR
+// names resolves back to it. The matching name is returned with a pass.
+func CheckIPRev(ip net.IP) (authres.ResultValue, string) {
+	names, err := net.LookupAddr(ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.Temporary() || dnsErr.IsTimeout) {
+			return authres.ResultTempError, ""
+		}
+		return authres.ResultFail, ""
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := net.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.Equal(ip) {
+				return authres.ResultPass, name
+			}
+		}
+	}
+	return authres.ResultFail, ""
+}
+
 func GetMXHosts(domain string) ([]string, error) {
 	var result []string
 
@@ -70,3 +101,78 @@ func GetRecord(domain string, ran int) (string, error) {
 
 	return strings.TrimRight(mxrecords[ran].Host, "."), nil
 }
+
+// lookupMX and mxPort are where deliverMX finds the MX hosts of a domain.
+var (
+	lookupMX = GetMXHosts
+	mxPort   = "smtp"
+)
+
+// deliverMX sends msg to the recipients of one domain, trying its MX hosts
+// in order. A 5xx reply is returned as is, anything else as a 451 once all
+// hosts failed.
+func deliverMX(domain, from string, to []string, msg []byte, utf8 bool) error {
+	hosts, err := lookupMX(domain)
+	if err != nil {
+		return NewNotFoundError(to[0])
+	}
+
+	for _, host := range hosts {
+		err = sendMX(host, from, to, msg, utf8)
+		if err == nil || permanentError(err) {
+			return err
+		}
+	}
+	return NewError(err)
+}
+
+// sendMX is smtp.SendMail, except that a SMTPUTF8 message is downgraded
+// for a host without the extension. Replies of the host come back as
+// SMTPErrors.
+func sendMX(host, from string, to []string, msg []byte, utf8 bool) error {
+	err := sendMXConn(host, from, to, msg, utf8)
+	if te, ok := err.(*textproto.Error); ok {
+		return replyError(te)
+	}
+	return err
+}
+
+func sendMXConn(host, from string, to []string, msg []byte, utf8 bool) error {
+	c, err := n_smtp.Dial(net.JoinHostPort(host, mxPort))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); utf8 && !ok {
+		if msg, err = downgrade(from, to, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
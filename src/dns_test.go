@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeMX answers every connection with the reply of rcpt to each RCPT and
+// 250 to everything else. It returns its address and a connection count.
+func fakeMX(t *testing.T, rcpt string) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	conns := new(int32)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go serveFakeMX(c, rcpt)
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+func serveFakeMX(c net.Conn, rcpt string) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("220 mx.test ESMTP\r\n"))
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if data {
+			if line == ".\r\n" {
+				data = false
+				c.Write([]byte("250 2.0.0 queued\r\n"))
+			}
+			continue
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"):
+			c.Write([]byte("250-mx.test\r\n250 8BITMIME\r\n"))
+		case strings.HasPrefix(cmd, "RCPT"):
+			c.Write([]byte(rcpt + "\r\n"))
+		case cmd == "DATA":
+			data = true
+			c.Write([]byte("354 go ahead\r\n"))
+		case cmd == "QUIT":
+			c.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			c.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+func useFakeMX(t *testing.T, addr string, hosts ...string) {
+	host, port, _ := net.SplitHostPort(addr)
+	if len(hosts) == 0 {
+		hosts = []string{host}
+	}
+	oldLookup, oldPort := lookupMX, mxPort
+	lookupMX = func(string) ([]string, error) { return hosts, nil }
+	mxPort = port
+	t.Cleanup(func() { lookupMX, mxPort = oldLookup, oldPort })
+}
+
+func TestDeliverMX(t *testing.T) {
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	tests := []struct {
+		name      string
+		rcpt      string
+		code      int
+		enhanced  string
+		conns     int32
+		permanent bool
+	}{
+		{"accepted", "250 2.1.5 ok", 0, "", 1, false},
+		{"permanent", "550 5.1.1 no such user", 550, "5.1.1", 1, true},
+		{"permanent without enhanced code", "550 no such user", 550, "5.0.0", 1, true},
+		{"temporary", "451 4.3.0 try later", 451, "4.5.1", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, conns := fakeMX(t, tt.rcpt)
+			// Both MX names point at the fake server.
+			useFakeMX(t, addr, "127.0.0.1", "localhost")
+
+			err := deliverMX("example.org", "a@example.net", []string{"b@example.org"}, msg, false)
+			if got := atomic.LoadInt32(conns); got != tt.conns {
+				t.Errorf("connections = %d, want %d", got, tt.conns)
+			}
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			se, ok := asSMTPError(err)
+			if !ok {
+				t.Fatalf("error %v (%T) is not an SMTPError", err, err)
+			}
+			if se.Code != tt.code {
+				t.Errorf("code = %d, want %d", se.Code, tt.code)
+			}
+			if permanentError(err) != tt.permanent {
+				t.Errorf("permanentError = %v, want %v", permanentError(err), tt.permanent)
+			}
+			if got := failedStatus(err); tt.permanent && got != tt.enhanced {
+				t.Errorf("failedStatus = %s, want %s", got, tt.enhanced)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DSNRecipient is one per-recipient block of a delivery status report.
+type DSNRecipient struct {
+	Recipient  string
+	Action     string
+	Status     string
+	Diagnostic string
+}
+
+// NewDSN builds a multipart/report delivery status notification (RFC 3464)
+// addressed to rcpt, quoting the headers of the original message.
+func NewDSN(conf *Config, rcpt string, recipients []DSNRecipient, original []byte) []byte {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", conf.ServerName)
+	fmt.Fprintf(buf, "To: <%s>\r\n", rcpt)
+	fmt.Fprintf(buf, "Subject: %s\r\n", dsnSubject(recipients))
+	fmt.Fprintf(buf, "Date: %s\r\n", now())
+	fmt.Fprintf(buf, "Message-ID: <%s>\r\n", NewMessageID(conf.ServerName))
+	fmt.Fprintf(buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", mw.Boundary())
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "This is a MIME-encapsulated message.\r\n\r\n")
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=us-ascii")
+	w, _ := mw.CreatePart(h)
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", conf.ServerName)
+	for _, r := range recipients {
+		fmt.Fprintf(w, "<%s>: %s", r.Recipient, r.Action)
+		if r.Diagnostic != "" {
+			fmt.Fprintf(w, ", %s", r.Diagnostic)
+		}
+		fmt.Fprintf(w, "\r\n")
+	}
+
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "message/delivery-status")
+	w, _ = mw.CreatePart(h)
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", conf.ServerName)
+	fmt.Fprintf(w, "Arrival-Date: %s\r\n", now())
+	for _, r := range recipients {
+		fmt.Fprintf(w, "\r\n")
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %s\r\n", r.Recipient)
+		fmt.Fprintf(w, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(w, "Status: %s\r\n", r.Status)
+		if r.Diagnostic != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\r\n", oneLine(r.Diagnostic))
+		}
+	}
+
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/rfc822-headers")
+	w, _ = mw.CreatePart(h)
+	w.Write(headerBlock(original))
+
+	mw.Close()
+	return buf.Bytes()
+}
+
+func dsnSubject(recipients []DSNRecipient) string {
+	for _, r := range recipients {
+		switch r.Action {
+		case "failed":
+			return "Undelivered Mail Returned to Sender"
+		case "delayed":
+			return "Delayed Mail (still being retried)"
+		}
+	}
+	return "Delivery Status Notification"
+}
+
+// sendDSN reports the failed or delayed recipients to from, which is what
+// RFC 3461 asks for when the client gave no NOTIFY. Nothing is sent to the
+// null sender.
+//
+// NOTIFY, ORCPT, RET and ENVID are not supported yet: go-smtp doesn't
+// advertise DSN and drops RET and ENVID before Session.Mail. Honouring them,
+// success reports included, waits on both being added to the go-smtp fork.
+func sendDSN(conf *Config, from string, recipients []DSNRecipient, original []byte) {
+	if from == "" || len(recipients) == 0 {
+		return
+	}
+	_, domain := StripEmail(from)
+	if domain == "" {
+		return
+	}
+
+	report := NewDSN(conf, from, recipients, original)
+	if err := deliverMX(domain, "", []string{from}, report, false); err != nil {
+		log.Println("[dsn]", recipients[0].Action, "report to", from, "failed:", err)
+	}
+}
+
+// dsnRecipients builds the report blocks of rcpts for one outcome.
+func dsnRecipients(rcpts []string, action, status, diagnostic string) []DSNRecipient {
+	list := make([]DSNRecipient, 0, len(rcpts))
+	for _, r := range rcpts {
+		list = append(list, DSNRecipient{Recipient: r, Action: action, Status: status, Diagnostic: diagnostic})
+	}
+	return list
+}
+
+// failedStatus is the status of a recipient given up on after err.
+func failedStatus(err error) string {
+	return "5" + statusFor(err, true)[1:]
+}
+
+// replyError turns a reply read with net/textproto into an SMTPError.
+func replyError(te *textproto.Error) error {
+	se := &smtp.SMTPError{Code: te.Code, Message: te.Msg}
+	if parts := strings.SplitN(te.Msg, " ", 2); len(parts) == 2 {
+		var c smtp.EnhancedCode
+		if _, err := fmt.Sscanf(parts[0], "%d.%d.%d", &c[0], &c[1], &c[2]); err == nil {
+			se.EnhancedCode, se.Message = c, parts[1]
+		}
+	}
+	return se
+}
+
+// headerBlock returns the header section of msg, including the empty line
+// that ends it.
+func headerBlock(msg []byte) []byte {
+	buf := new(bytes.Buffer)
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(msg)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+		if line == "" {
+			break
+		}
+	}
+	return buf.Bytes()
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// statusFor turns a delivery error into an enhanced status code.
+func statusFor(err error, permanent bool) string {
+	if se, ok := asSMTPError(err); ok && se.EnhancedCode[0] != 0 {
+		return fmt.Sprintf("%d.%d.%d", se.EnhancedCode[0], se.EnhancedCode[1], se.EnhancedCode[2])
+	}
+	if permanent {
+		return "5.0.0"
+	}
+	return "4.0.0"
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRcptAddress(t *testing.T) {
+	tests := []struct {
+		arg, addr string
+		ok        bool
+	}{
+		{"b@example.org", "b@example.org", true},
+		{"<b@example.org>", "b@example.org", true},
+		{"", "", true},
+		{"b@example.org> NOTIFY=SUCCESS,FAILURE", "b@example.org", false},
+		{"b@example.org> ORCPT=rfc822;b@example.org", "b@example.org", false},
+		{"b@example.org>  ", "b@example.org", true},
+	}
+	for _, tt := range tests {
+		addr, err := rcptAddress(tt.arg)
+		if addr != tt.addr || (err == nil) != tt.ok {
+			t.Errorf("rcptAddress(%q) = %q, %v", tt.arg, addr, err)
+		}
+	}
+}
+
+func TestNewDSN(t *testing.T) {
+	conf := &Config{ServerName: "mx.example.org"}
+	original := []byte("From: a@example.net\r\nSubject: report\r\n\r\nsecret body\r\n")
+	recipients := []DSNRecipient{
+		{Recipient: "b@example.org", Action: "failed", Status: "5.1.1", Diagnostic: "550 5.1.1\r\n no such user"},
+		{Recipient: "c@example.org", Action: "failed", Status: "5.0.0"},
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(NewDSN(conf, "a@example.net", recipients, original)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Undelivered Mail Returned to Sender" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := msg.Header.Get("Auto-Submitted"); got != "auto-replied" {
+		t.Errorf("Auto-Submitted = %q", got)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Content-Type = %q", msg.Header.Get("Content-Type"))
+	}
+
+	var types, bodies []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(b))
+	}
+	if len(types) != 3 || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("parts = %q", types)
+	}
+
+	status := bodies[1]
+	for _, want := range []string{
+		"Reporting-MTA: dns; mx.example.org\r\n",
+		"Final-Recipient: rfc822; b@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 no such user\r\n",
+		"Final-Recipient: rfc822; c@example.org\r\nAction: failed\r\nStatus: 5.0.0\r\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("delivery-status lacks %q:\n%s", want, status)
+		}
+	}
+	if strings.Count(status, "Diagnostic-Code") != 1 {
+		t.Errorf("empty diagnostic reported:\n%s", status)
+	}
+	if bodies[2] != "From: a@example.net\r\nSubject: report\r\n\r\n" {
+		t.Errorf("headers part = %q", bodies[2])
+	}
+}
+
+func TestDSNSubject(t *testing.T) {
+	tests := []struct {
+		actions []string
+		want    string
+	}{
+		{[]string{"failed"}, "Undelivered Mail Returned to Sender"},
+		{[]string{"delayed"}, "Delayed Mail (still being retried)"},
+		{[]string{"relayed", "delayed"}, "Delayed Mail (still being retried)"},
+		{[]string{"delivered"}, "Delivery Status Notification"},
+	}
+	for _, tt := range tests {
+		var recipients []DSNRecipient
+		for _, a := range tt.actions {
+			recipients = append(recipients, DSNRecipient{Action: a})
+		}
+		if got := dsnSubject(recipients); got != tt.want {
+			t.Errorf("dsnSubject(%v) = %q, want %q", tt.actions, got, tt.want)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	tests := []struct {
+		code     int
+		msg      string
+		enhanced string
+		text     string
+	}{
+		{550, "5.1.1 no such user", "5.1.1", "no such user"},
+		{550, "no such user", "5.0.0", "no such user"},
+		{452, "4.2.2 mailbox full", "4.2.2", "mailbox full"},
+	}
+	for _, tt := range tests {
+		err := replyError(&textproto.Error{Code: tt.code, Msg: tt.msg})
+		se, ok := asSMTPError(err)
+		if !ok || se.Code != tt.code || se.Message != tt.text {
+			t.Errorf("replyError(%d %s) = %v", tt.code, tt.msg, err)
+			continue
+		}
+		if got := failedStatus(err); got != "5"+tt.enhanced[1:] {
+			t.Errorf("failedStatus(%d %s) = %s", tt.code, tt.msg, got)
+		}
+	}
+	if got := failedStatus(errors.New("connection refused")); got != "5.0.0" {
+		t.Errorf("failedStatus of a plain error = %s", got)
+	}
+}
+
+func TestSendDSN(t *testing.T) {
+	conf := &Config{ServerName: "mx.example.org"}
+	failed := dsnRecipients([]string{"b@example.org"}, "failed", "5.1.1", "550 no such user")
+	tests := []struct {
+		name       string
+		from       string
+		recipients []DSNRecipient
+		conns      int32
+	}{
+		{"sender", "a@example.net", failed, 1},
+		{"null sender", "", failed, 0},
+		{"no recipients", "a@example.net", nil, 0},
+		{"no domain", "postmaster", failed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, conns := fakeMX(t, "250 ok")
+			useFakeMX(t, addr)
+
+			sendDSN(conf, tt.from, tt.recipients, []byte("Subject: x\r\n\r\n"))
+			if got := atomic.LoadInt32(conns); got != tt.conns {
+				t.Errorf("connections = %d, want %d", got, tt.conns)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/emersion/go-smtp"
@@ -15,6 +16,24 @@ func NewNotMemberError(email string) error {
 	}
 }
 
+// NewUnknownRecipientError rejects a single RCPT without closing the
+// connection, so the other recipients of the message can still be accepted.
+func NewUnknownRecipientError(email string) error {
+	return &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+		Message:      fmt.Sprintf("<%s>... User unknown, not local address.", email),
+	}
+}
+
+func NewBadRecipientError(email string) error {
+	return &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      fmt.Sprintf("<%s>... Bad recipient address syntax.", email),
+	}
+}
+
 func NewAuthorizationError(email string) error {
 	return &smtp.SMTPError{
 		Code:         550,
@@ -46,3 +65,196 @@ func NewError(err error) error {
 		Message:      fmt.Sprintf("%s", err.Error()),
 	}
 }
+
+func NewAuthFailedError() error {
+	return &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+}
+
+func NewAuthTempError() error {
+	return &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Temporary authentication failure",
+	}
+}
+
+func NewSenderNotOwnedError(email string) error {
+	return &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("<%s>... Sender address not owned by user.", email),
+	}
+}
+
+func NewInvalidSRSError(email string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      fmt.Sprintf("<%s>... Invalid or expired SRS address.", email),
+	}
+}
+
+func NewDKIMRequiredError(domain string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+		Message:      fmt.Sprintf("No valid DKIM signature of %s found.", domain),
+	}
+}
+
+func NewDMARCRejectError(domain string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Rejected by the DMARC policy of %s.", domain),
+	}
+}
+
+func NewSPFFailError(domain string, result string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+		Message:      fmt.Sprintf("SPF validation failed for %s (%s).", domain, result),
+	}
+}
+
+func NewSPFTempError(domain string, result string) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 24},
+		Message:      fmt.Sprintf("SPF validation error for %s (%s), try again later.", domain, result),
+	}
+}
+
+func NewGreylistedError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again later.",
+	}
+}
+
+func NewTooManyConnectionsError() error {
+	return &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections from your network, try again later.",
+		ForceClose:   true,
+	}
+}
+
+func NewMessageRateError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Message rate limit exceeded, try again later.",
+	}
+}
+
+func NewRcptRateError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Recipient rate limit exceeded, try again later.",
+	}
+}
+
+func asSMTPError(err error) (*smtp.SMTPError, bool) {
+	var se *smtp.SMTPError
+	if errors.As(err, &se) {
+		return se, true
+	}
+	return nil, false
+}
+
+// permanentError reports whether err is a 5xx reply.
+func permanentError(err error) bool {
+	se, ok := asSMTPError(err)
+	return ok && se.Code >= 500
+}
+
+func NewMessageTooLargeError() error {
+	return &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message size exceeds fixed maximum message size",
+	}
+}
+
+func NewBadSenderError(email string) error {
+	return &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      fmt.Sprintf("<%s>... Bad sender address syntax.", email),
+	}
+}
+
+// NewUTF8RequiredError refuses a non-ASCII address given without the
+// SMTPUTF8 parameter.
+func NewUTF8RequiredError(email string) error {
+	return &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+		Message:      fmt.Sprintf("<%s>... Non-ASCII address requires SMTPUTF8.", email),
+	}
+}
+
+func NewDowngradeError(email string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+		Message:      fmt.Sprintf("<%s>... Next hop does not support SMTPUTF8.", email),
+	}
+}
+
+func NewBadParameterError(err error) error {
+	return &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      fmt.Sprintf("Error: %s", err),
+	}
+}
+
+func NewMilterRejectError() error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Command rejected",
+	}
+}
+
+func NewMilterTempError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Service unavailable - try again later",
+	}
+}
+
+func NewSpamRejectError() error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected as spam.",
+	}
+}
+
+func NewScanTempError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Content scanner unavailable, try again later.",
+	}
+}
+
+func NewVirusError(name string) error {
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Message rejected: infected with %s.", name),
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mileusna/spf"
+
+	"gosmtp/src/store"
+)
+
+type GreylistSetting struct {
+	Enabled bool
+	// A new triplet is deferred until Delay has passed and must be retried
+	// within Window. Passed triplets are remembered for Lifetime.
+	Delay    time.Duration
+	Window   time.Duration
+	Lifetime time.Duration
+	// WhitelistAfter passing deliveries from a client network exempt it
+	// from greylisting, zero disables the auto-whitelist.
+	WhitelistAfter int
+
+	ExemptNetworks []*net.IPNet
+	ExemptDomains  map[string]bool
+	ExemptSPFPass  bool
+}
+
+var DefaultGreylist = GreylistSetting{
+	Delay:          5 * time.Minute,
+	Window:         24 * time.Hour,
+	Lifetime:       36 * 24 * time.Hour,
+	WhitelistAfter: 5,
+}
+
+// networkKey returns the /24 of an IPv4 or the /64 of an IPv6 address, so
+// that clients retrying from a neighbouring address are treated alike.
+func networkKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func inNetworks(list []*net.IPNet, ip net.IP) bool {
+	for _, n := range list {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// exempt reports whether a client or sender skips greylisting.
+func (g GreylistSetting) exempt(ip net.IP, from string, spfResult spf.Result, now time.Time) bool {
+	if inNetworks(g.ExemptNetworks, ip) {
+		return true
+	}
+	if g.ExemptSPFPass && spfResult == spf.Pass {
+		return true
+	}
+
+	_, domain := StripEmail(from)
+	for d := normalizeHost(domain); d != ""; {
+		if g.ExemptDomains[d] {
+			return true
+		}
+		l := strings.IndexByte(d, '.')
+		if l < 0 {
+			break
+		}
+		d = d[l+1:]
+	}
+
+	return store.GreylistWhitelisted(networkKey(ip), now, g.WhitelistAfter, g.Lifetime)
+}
+
+// pass reports whether a recipient may be accepted now.
+func (g GreylistSetting) pass(ip net.IP, from, to string, now time.Time) bool {
+	key := networkKey(ip) + " " + strings.ToLower(from) + " " + strings.ToLower(to)
+	return store.CheckGreylist(key, now, g.Delay, g.Window, g.Lifetime)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeDomain returns the lowercase A-label form of domain, so that
+// "Bücher.example" and "xn--bcher-kva.example" compare equal. Address
+// literals are returned as they are.
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	if strings.HasPrefix(domain, "[") {
+		return domain, nil
+	}
+	d, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(d), nil
+}
+
+// NormalizeAddress converts the domain of addr to its A-label form. The
+// local part is kept, it is up to the receiving host.
+func NormalizeAddress(addr string) (string, error) {
+	local, host := StripEmail(addr)
+	if host == "" {
+		return strings.TrimSpace(addr), nil
+	}
+	d, err := NormalizeDomain(host)
+	if err != nil {
+		return "", err
+	}
+	return local + "@" + d, nil
+}
+
+// normalizeHost is NormalizeDomain for comparisons, an invalid domain is
+// only lowercased.
+func normalizeHost(host string) string {
+	if d, err := NormalizeDomain(host); err == nil {
+		return d
+	}
+	return strings.ToLower(host)
+}
+
+// normalizeKey lowercases a domain, an address or a route pattern and
+// converts its domain to A-labels.
+func normalizeKey(k string) string {
+	k = strings.ToLower(strings.TrimSpace(k))
+	switch {
+	case k == "*":
+		return k
+	case strings.HasPrefix(k, "*."):
+		return "*." + normalizeHost(k[2:])
+	}
+	if l := strings.LastIndexByte(k, '@'); l >= 0 {
+		return k[:l+1] + normalizeHost(k[l+1:])
+	}
+	return normalizeHost(k)
+}
+
+func isASCII(s string) bool {
+	for n := 0; n < len(s); n++ {
+		if s[n] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// needsUTF8 reports whether addr stays non-ASCII once its domain is in
+// A-label form.
+func needsUTF8(addr string) bool {
+	local, _ := StripEmail(addr)
+	return !isASCII(local)
+}
+
+var addressFields = map[string]bool{
+	"from": true, "sender": true, "reply-to": true, "to": true, "cc": true, "bcc": true,
+	"resent-from": true, "resent-sender": true, "resent-to": true, "resent-cc": true, "resent-bcc": true,
+}
+
+// downgrade prepares a SMTPUTF8 message for a next hop without the
+// extension: domains in address fields become A-labels and other non-ASCII
+// fields are RFC 2047 encoded. A non-ASCII local part can't be downgraded
+// and is refused.
+func downgrade(from string, to []string, msg []byte) ([]byte, error) {
+	for _, addr := range append([]string{from}, to...) {
+		if needsUTF8(addr) {
+			return nil, NewDowngradeError(addr)
+		}
+	}
+
+	fields, body := splitMessage(msg)
+	buf := new(bytes.Buffer)
+	for _, f := range fields {
+		if isASCII(f) {
+			buf.WriteString(f)
+			continue
+		}
+
+		name := fieldName(f)
+		value := strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(fieldValue(f)))
+		if !addressFields[strings.ToLower(name)] {
+			buf.WriteString(name + ": " + mime.QEncoding.Encode("utf-8", value) + "\r\n")
+			continue
+		}
+
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			return nil, NewDowngradeError(from)
+		}
+		addrs := make([]string, 0, len(list))
+		for _, a := range list {
+			if needsUTF8(a.Address) {
+				return nil, NewDowngradeError(a.Address)
+			}
+			if a.Address, err = NormalizeAddress(a.Address); err != nil {
+				return nil, NewDowngradeError(from)
+			}
+			addrs = append(addrs, a.String())
+		}
+		buf.WriteString(name + ": " + strings.Join(addrs, ",\r\n\t") + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
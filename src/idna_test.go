@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+		fails    bool
+	}{
+		{"example.jp", "example.jp", false},
+		{"Example.JP.", "example.jp", false},
+		{"Bücher.example", "xn--bcher-kva.example", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", false},
+		{"日本語.jp", "xn--wgv71a119e.jp", false},
+		{"[192.0.2.1]", "[192.0.2.1]", false},
+		{"a_b.example", "", true},
+		{"xn--a.example", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeDomain(tt.in)
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("NormalizeDomain(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"*", "*"},
+		{" Example.ORG ", "example.org"},
+		{"*.Example.Org", "*.example.org"},
+		{"Alice@Example.Org", "alice@example.org"},
+		{"Info@Bücher.Example", "info@xn--bcher-kva.example"},
+		{"*.BÜCHER.example", "*.xn--bcher-kva.example"},
+		{"a@b@Example.ORG", "a@b@example.org"},
+	}
+	for _, tt := range tests {
+		if got := normalizeKey(tt.in); got != tt.want {
+			t.Errorf("normalizeKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	msg := "From: Ålice <alice@bücher.example>\r\n" +
+		"To: bob@example.org, carol@日本語.jp\r\n" +
+		"Subject: Grüße\r\n" +
+		"Message-ID: <1@example.org>\r\n" +
+		"\r\n" +
+		"Grüße\r\n"
+	got, err := downgrade("alice@bücher.example", []string{"bob@example.org"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: =?utf-8?q?=C3=85lice?= <alice@xn--bcher-kva.example>\r\n" +
+		"To: <bob@example.org>,\r\n\t<carol@xn--wgv71a119e.jp>\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"Message-ID: <1@example.org>\r\n" +
+		"\r\n" +
+		"Grüße\r\n"
+	if string(got) != want {
+		t.Errorf("downgrade =\n%s\nwant\n%s", got, want)
+	}
+
+	refused := []struct {
+		name, from string
+		to         []string
+		msg, addr  string
+	}{
+		{"sender", "ålice@example.org", nil, "Subject: hi\r\n\r\n", "ålice@example.org"},
+		{"recipient", "alice@example.org", []string{"bob@example.org", "jürgen@example.org"}, "Subject: hi\r\n\r\n", "jürgen@example.org"},
+		{"header", "alice@example.org", nil, "Cc: jürgen@example.org\r\n\r\n", "jürgen@example.org"},
+	}
+	for _, tt := range refused {
+		_, err := downgrade(tt.from, tt.to, []byte(tt.msg))
+		if se, ok := asSMTPError(err); !ok || se.Code != 550 || !strings.Contains(se.Message, "<"+tt.addr+">") {
+			t.Errorf("%s: downgrade = %v, want a refusal", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,1191 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	s := make([]string, len(e))
+	for n, err := range e {
+		s[n] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+type fileConfig struct {
+	Name          string                    `yaml:"name" toml:"name"`
+	ServerName    string                    `yaml:"server_name" toml:"server_name"`
+	ProxyAddress  string                    `yaml:"proxy_address" toml:"proxy_address"`
+	ProxyEnvelope string                    `yaml:"proxy_envelope" toml:"proxy_envelope"`
+	FromName      string                    `yaml:"from_name" toml:"from_name"`
+	ListenDomains []string                  `yaml:"listen_domains" toml:"listen_domains"`
+	Upstream      []fileUpstream            `yaml:"upstream" toml:"upstream"`
+	Upstreams     map[string][]fileUpstream `yaml:"upstreams" toml:"upstreams"`
+	Health        *fileHealth               `yaml:"health" toml:"health"`
+	ConnPool      *fileConnPool             `yaml:"conn_pool" toml:"conn_pool"`
+	Routes        []fileRoute               `yaml:"routes" toml:"routes"`
+	Listeners     []fileListener            `yaml:"listeners" toml:"listeners"`
+	Allocation    fileAllocation            `yaml:"allocation" toml:"allocation"`
+	Users         []fileUser                `yaml:"users" toml:"users"`
+	Htpasswd      string                    `yaml:"htpasswd" toml:"htpasswd"`
+	Senders       map[string][]string       `yaml:"senders" toml:"senders"`
+	Lockout       *fileLockout              `yaml:"lockout" toml:"lockout"`
+	Spool         *fileSpool                `yaml:"spool" toml:"spool"`
+	SRS           *fileSRS                  `yaml:"srs" toml:"srs"`
+	Dkim          fileDkim                  `yaml:"dkim" toml:"dkim"`
+	Spf           *fileSpf                  `yaml:"spf" toml:"spf"`
+	Greylist      *fileGreylist             `yaml:"greylist" toml:"greylist"`
+	RateLimit     *fileRateLimit            `yaml:"rate_limit" toml:"rate_limit"`
+	DkimVerify    *fileDkimVerify           `yaml:"dkim_verify" toml:"dkim_verify"`
+	Dmarc         *fileDmarc                `yaml:"dmarc" toml:"dmarc"`
+	Spam          *fileSpam                 `yaml:"spam" toml:"spam"`
+	Virus         *fileVirus                `yaml:"virus" toml:"virus"`
+	QuarantineTo  string                    `yaml:"quarantine_to" toml:"quarantine_to"`
+}
+
+type fileUpstream struct {
+	Addr     string `yaml:"addr" toml:"addr"`
+	Security string `yaml:"security" toml:"security"`
+	LMTP     bool   `yaml:"lmtp" toml:"lmtp"`
+	Host     string `yaml:"host" toml:"host"`
+	Priority int    `yaml:"priority" toml:"priority"`
+	Weight   int    `yaml:"weight" toml:"weight"`
+}
+
+type fileConnPool struct {
+	MaxIdle     int    `yaml:"max_idle" toml:"max_idle"`
+	MaxAge      string `yaml:"max_age" toml:"max_age"`
+	IdleTimeout string `yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+type fileHealth struct {
+	Interval  string `yaml:"interval" toml:"interval"`
+	Threshold int    `yaml:"threshold" toml:"threshold"`
+	Cooldown  string `yaml:"cooldown" toml:"cooldown"`
+}
+
+type fileRoute struct {
+	Match    string   `yaml:"match" toml:"match"`
+	To       []string `yaml:"to" toml:"to"`
+	Upstream string   `yaml:"upstream" toml:"upstream"`
+	Envelope string   `yaml:"envelope" toml:"envelope"`
+}
+
+type fileListener struct {
+	Addr            string       `yaml:"addr" toml:"addr"`
+	Port            int          `yaml:"port" toml:"port"`
+	Role            string       `yaml:"role" toml:"role"`
+	TlsCert         string       `yaml:"tls_cert" toml:"tls_cert"`
+	TlsKey          string       `yaml:"tls_key" toml:"tls_key"`
+	ReadTimeout     int          `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    int          `yaml:"write_timeout" toml:"write_timeout"`
+	MaxMessageBytes *int         `yaml:"max_message_bytes" toml:"max_message_bytes"`
+	Milters         []fileMilter `yaml:"milters" toml:"milters"`
+}
+
+type fileMilter struct {
+	Name          string `yaml:"name" toml:"name"`
+	Address       string `yaml:"address" toml:"address"`
+	Timeout       string `yaml:"timeout" toml:"timeout"`
+	DefaultAction string `yaml:"default_action" toml:"default_action"`
+}
+
+type fileAllocation struct {
+	ToAddresses    []string `yaml:"to_addresses" toml:"to_addresses"`
+	ToDomains      []string `yaml:"to_domains" toml:"to_domains"`
+	BlacklistHosts []string `yaml:"blacklist_hosts" toml:"blacklist_hosts"`
+}
+
+type fileUser struct {
+	Name            string   `yaml:"name" toml:"name"`
+	Password        string   `yaml:"password" toml:"password"`
+	PasswordHash    string   `yaml:"password_hash" toml:"password_hash"`
+	AllowedFrom     []string `yaml:"allowed_from" toml:"allowed_from"`
+	MaxMessageBytes int      `yaml:"max_message_bytes" toml:"max_message_bytes"`
+}
+
+type fileLockout struct {
+	MaxUserFailures int    `yaml:"max_user_failures" toml:"max_user_failures"`
+	MaxIPFailures   int    `yaml:"max_ip_failures" toml:"max_ip_failures"`
+	Window          string `yaml:"window" toml:"window"`
+	Duration        string `yaml:"duration" toml:"duration"`
+	BaseDelay       string `yaml:"base_delay" toml:"base_delay"`
+	MaxDelay        string `yaml:"max_delay" toml:"max_delay"`
+}
+
+type fileSpool struct {
+	Dir          string `yaml:"dir" toml:"dir"`
+	MaxLifetime  string `yaml:"max_lifetime" toml:"max_lifetime"`
+	RetryBase    string `yaml:"retry_base" toml:"retry_base"`
+	RetryMax     string `yaml:"retry_max" toml:"retry_max"`
+	DelayWarning string `yaml:"delay_warning" toml:"delay_warning"`
+}
+
+type fileSRS struct {
+	Domain  string   `yaml:"domain" toml:"domain"`
+	Secrets []string `yaml:"secrets" toml:"secrets"`
+	MaxAge  int      `yaml:"max_age" toml:"max_age"`
+}
+
+type fileDkim struct {
+	Domain   string `yaml:"domain" toml:"domain"`
+	Selector string `yaml:"selector" toml:"selector"`
+	Private  string `yaml:"private" toml:"private"`
+}
+
+type fileSpf struct {
+	Fail      string `yaml:"fail" toml:"fail"`
+	Softfail  string `yaml:"softfail" toml:"softfail"`
+	PermError string `yaml:"permerror" toml:"permerror"`
+	TempError string `yaml:"temperror" toml:"temperror"`
+	None      string `yaml:"none" toml:"none"`
+}
+
+type fileGreylist struct {
+	Delay          string   `yaml:"delay" toml:"delay"`
+	Window         string   `yaml:"window" toml:"window"`
+	Lifetime       string   `yaml:"lifetime" toml:"lifetime"`
+	WhitelistAfter *int     `yaml:"whitelist_after" toml:"whitelist_after"`
+	ExemptNetworks []string `yaml:"exempt_networks" toml:"exempt_networks"`
+	ExemptDomains  []string `yaml:"exempt_domains" toml:"exempt_domains"`
+	ExemptSPFPass  bool     `yaml:"exempt_spf_pass" toml:"exempt_spf_pass"`
+}
+
+type fileRateLimits struct {
+	Connections       int `yaml:"connections" toml:"connections"`
+	MessagesPerMinute int `yaml:"messages_per_minute" toml:"messages_per_minute"`
+	RecipientsPerHour int `yaml:"recipients_per_hour" toml:"recipients_per_hour"`
+}
+
+type fileRateLimit struct {
+	PerIP      fileRateLimits `yaml:"per_ip" toml:"per_ip"`
+	PerNetwork fileRateLimits `yaml:"per_network" toml:"per_network"`
+	Whitelist  []string       `yaml:"whitelist" toml:"whitelist"`
+}
+
+type fileDkimVerify struct {
+	MustSign []string `yaml:"must_sign" toml:"must_sign"`
+	Policy   string   `yaml:"policy" toml:"policy"`
+}
+
+type fileDmarc struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+}
+
+type fileSpam struct {
+	Type          string  `yaml:"type" toml:"type"`
+	Address       string  `yaml:"address" toml:"address"`
+	User          string  `yaml:"user" toml:"user"`
+	Password      string  `yaml:"password" toml:"password"`
+	Timeout       string  `yaml:"timeout" toml:"timeout"`
+	Tag           float64 `yaml:"tag" toml:"tag"`
+	Subject       float64 `yaml:"subject" toml:"subject"`
+	SubjectTag    string  `yaml:"subject_tag" toml:"subject_tag"`
+	Quarantine    float64 `yaml:"quarantine" toml:"quarantine"`
+	Reject        float64 `yaml:"reject" toml:"reject"`
+	DefaultAction string  `yaml:"default_action" toml:"default_action"`
+}
+
+type fileVirus struct {
+	Address       string `yaml:"address" toml:"address"`
+	Timeout       string `yaml:"timeout" toml:"timeout"`
+	Action        string `yaml:"action" toml:"action"`
+	DefaultAction string `yaml:"default_action" toml:"default_action"`
+}
+
+// positions maps a dotted key path such as "dkim.private" or "users.0.name"
+// to the line it was found on.
+type positions map[string]int
+
+func (p positions) line(key string) int {
+	for key != "" {
+		if l, ok := p[key]; ok {
+			return l
+		}
+		n := strings.LastIndex(key, ".")
+		if n < 0 {
+			break
+		}
+		key = key[:n]
+	}
+	return 0
+}
+
+type configLoader struct {
+	file string
+	pos  positions
+	errs ConfigErrors
+}
+
+func (l *configLoader) errorf(key string, format string, args ...interface{}) {
+	l.errs = append(l.errs, &ConfigError{
+		File: l.file,
+		Line: l.pos.line(key),
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &configLoader{file: path}
+	fc := new(fileConfig)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = l.decodeYAML(b, fc)
+	case ".toml":
+		err = l.decodeTOML(b, fc)
+	default:
+		return nil, &ConfigError{File: path, Msg: "unknown config format, use .yaml, .yml or .toml"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conf := l.build(fc)
+	if len(l.errs) > 0 {
+		return nil, l.errs
+	}
+	return conf, nil
+}
+
+func (l *configLoader) decodeYAML(b []byte, fc *fileConfig) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return &ConfigError{File: l.file, Msg: err.Error()}
+	}
+	l.pos = positions{}
+	yamlPositions(l.pos, "", &root)
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err := dec.Decode(fc)
+	var terr *yaml.TypeError
+	switch {
+	case err == nil, err == io.EOF:
+		return nil
+	case errors.As(err, &terr):
+		var errs ConfigErrors
+		for _, msg := range terr.Errors {
+			errs = append(errs, l.decodeError(msg))
+		}
+		return errs
+	}
+	return l.decodeError(err.Error())
+}
+
+// decodeLine matches the line the YAML and TOML decoders put in their
+// messages.
+var decodeLine = regexp.MustCompile(`^(?:yaml: |toml: )?line (\d+)(?: \(last key "([^"]*)"\))?: (.*)$`)
+
+// decodeError turns a decoder message into a ConfigError with its line.
+func (l *configLoader) decodeError(msg string) *ConfigError {
+	m := decodeLine.FindStringSubmatch(msg)
+	if m == nil {
+		return &ConfigError{File: l.file, Msg: msg}
+	}
+	n, _ := strconv.Atoi(m[1])
+	if m[2] != "" {
+		return &ConfigError{File: l.file, Line: n, Msg: m[2] + ": " + m[3]}
+	}
+	return &ConfigError{File: l.file, Line: n, Msg: m[3]}
+}
+
+func yamlPositions(p positions, prefix string, n *yaml.Node) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			yamlPositions(p, prefix, c)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := join(n.Content[i].Value)
+			p[k] = n.Content[i].Line
+			yamlPositions(p, k, n.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			k := join(strconv.Itoa(i))
+			p[k] = c.Line
+			yamlPositions(p, k, c)
+		}
+	}
+}
+
+func (l *configLoader) decodeTOML(b []byte, fc *fileConfig) error {
+	md, err := toml.Decode(string(b), fc)
+	if err != nil {
+		return l.decodeError(err.Error())
+	}
+	var lines map[string][]int
+	l.pos, lines = tomlPositions(b)
+
+	// Keys of array of tables come without their index, one per
+	// occurrence in file order.
+	var errs ConfigErrors
+	seen := map[string]int{}
+	for _, k := range md.Undecoded() {
+		key := k.String()
+		line := l.pos.line(key)
+		if n := seen[key]; n < len(lines[key]) {
+			line = lines[key][n]
+		}
+		seen[key]++
+		errs = append(errs, &ConfigError{
+			File: l.file,
+			Line: line,
+			Msg:  fmt.Sprintf("unknown key %q", key),
+		})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// tomlPositions records the line of every table header and key assignment.
+// Array of tables get an index per header so that "[[users]]" blocks map to
+// "users.0", "users.1" and so on, matching the YAML key paths. The lines of
+// the keys in array of tables are also returned under their path without
+// index, in file order.
+func tomlPositions(b []byte) (positions, map[string][]int) {
+	p := positions{}
+	lines := map[string][]int{}
+	arrays := map[string]int{}
+	table, plain := "", ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[["):
+			name := strings.TrimSpace(strings.Trim(line, "[] "))
+			table, plain = name+"."+strconv.Itoa(arrays[name]), name
+			arrays[name]++
+			p[name] = n
+			p[table] = n
+		case strings.HasPrefix(line, "["):
+			table, plain = strings.TrimSpace(strings.Trim(line, "[] ")), ""
+			p[table] = n
+		default:
+			eq := strings.Index(line, "=")
+			if eq < 1 {
+				continue
+			}
+			key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+			if plain != "" {
+				lines[plain+"."+key] = append(lines[plain+"."+key], n)
+			}
+			if table != "" {
+				key = table + "." + key
+			}
+			p[key] = n
+		}
+	}
+	return p, lines
+}
+
+func (l *configLoader) build(fc *fileConfig) *Config {
+	conf := &Config{
+		Name:          fc.Name,
+		ServerName:    fc.ServerName,
+		ProxyAddress:  fc.ProxyAddress,
+		ProxyEnvelope: fc.ProxyEnvelope,
+		FromName:      fc.FromName,
+		DkimDomain:    fc.Dkim.Domain,
+		DkimSelector:  fc.Dkim.Selector,
+		DkimPrivate:   fc.Dkim.Private,
+		Allocation: AllocationSetting{
+			ToAddresses:    toSet(fc.Allocation.ToAddresses),
+			ToDomains:      toSet(fc.Allocation.ToDomains),
+			BlacklistHosts: toSet(fc.Allocation.BlacklistHosts),
+		},
+	}
+	if conf.Name == "" {
+		conf.Name = "Fujinami SMTP Transfer"
+	}
+
+	for _, d := range fc.ListenDomains {
+		conf.ListenDomains = append(conf.ListenDomains, ListenDomain(d))
+	}
+
+	conf.Upstream = l.buildPool("upstream", fc.Upstream)
+	if len(fc.Upstreams) > 0 {
+		conf.Upstreams = map[string][]Upstream{}
+		for name, list := range fc.Upstreams {
+			conf.Upstreams[name] = l.buildPool("upstreams."+name, list)
+		}
+	}
+	if fc.Health != nil {
+		conf.Health = l.buildHealth(fc.Health)
+	}
+	if fc.ConnPool != nil {
+		def := DefaultConnPool
+		conf.ConnPool = ConnPoolSetting{
+			MaxIdle:     def.MaxIdle,
+			MaxAge:      l.duration("conn_pool.max_age", fc.ConnPool.MaxAge, def.MaxAge),
+			IdleTimeout: l.duration("conn_pool.idle_timeout", fc.ConnPool.IdleTimeout, def.IdleTimeout),
+		}
+		if fc.ConnPool.MaxIdle != 0 {
+			conf.ConnPool.MaxIdle = fc.ConnPool.MaxIdle
+		}
+	}
+	conf.Allocation.Routes = l.buildRoutes(fc.Routes)
+	for n, fl := range fc.Listeners {
+		conf.Listeners = append(conf.Listeners, l.buildListener("listeners."+strconv.Itoa(n), fl))
+	}
+
+	for _, u := range fc.Users {
+		conf.Users = append(conf.Users, User{
+			Name:            u.Name,
+			PlainPassword:   u.Password,
+			Password:        u.PasswordHash,
+			AllowedFrom:     u.AllowedFrom,
+			MaxMessageBytes: u.MaxMessageBytes,
+		})
+	}
+
+	if fc.Htpasswd != "" {
+		hs, err := NewHtpasswdStore(fc.Htpasswd)
+		if err != nil {
+			l.errorf("htpasswd", "%s", err)
+		} else {
+			hs.Senders = fc.Senders
+			conf.UserStore = hs
+		}
+	}
+	if len(fc.Senders) > 0 && fc.Htpasswd == "" {
+		l.errorf("senders", "senders is only used with htpasswd, set allowed_from on users instead")
+	}
+	for name, list := range fc.Senders {
+		l.checkSenders("senders."+name, list)
+	}
+
+	if fc.Lockout != nil {
+		conf.Lockout = l.buildLockout(fc.Lockout)
+	}
+
+	if fc.Spool != nil {
+		conf.Spool = l.buildSpool(fc.Spool)
+	}
+
+	if fc.SRS != nil {
+		conf.SRS = SRSSetting{Domain: fc.SRS.Domain, Secrets: fc.SRS.Secrets, MaxAge: fc.SRS.MaxAge}
+		if conf.SRS.Domain == "" {
+			conf.SRS.Domain = conf.ServerName
+		}
+	}
+
+	if fc.Spf != nil {
+		conf.SPF = l.buildSpf(fc.Spf)
+	}
+
+	if fc.Greylist != nil {
+		conf.Greylist = l.buildGreylist(fc.Greylist)
+	}
+
+	if fc.RateLimit != nil {
+		conf.RateLimit = RateLimitSetting{
+			PerIP:      RateLimits(fc.RateLimit.PerIP),
+			PerNetwork: RateLimits(fc.RateLimit.PerNetwork),
+			Whitelist:  l.networks("rate_limit.whitelist", fc.RateLimit.Whitelist),
+		}
+	}
+
+	if fc.DkimVerify != nil {
+		conf.DKIMVerify = DKIMVerifySetting{
+			MustSign: toSet(fc.DkimVerify.MustSign),
+			Policy:   l.policyAction("dkim_verify.policy", fc.DkimVerify.Policy, ActionTag, ActionAccept, ActionTag, ActionReject),
+		}
+	}
+
+	if fc.Dmarc != nil {
+		conf.DMARC = DMARCSetting{Enabled: fc.Dmarc.Enabled}
+	}
+
+	if fc.Spam != nil {
+		conf.Spam = l.buildSpam(fc.Spam)
+	}
+
+	if fc.Virus != nil {
+		conf.Virus = l.buildVirus(fc.Virus)
+	}
+	conf.QuarantineTo = fc.QuarantineTo
+
+	conf.validate(l)
+	return conf
+}
+
+// validate reports what is wrong with conf, under the keys of the config
+// file so that LoadConfig can point at the lines. It is the one set of
+// rules for a config, loaded at startup or on reload.
+func (conf *Config) validate(l *configLoader) {
+	if conf.ServerName == "" {
+		l.errorf("server_name", "server_name is required")
+	}
+	if conf.ProxyAddress == "" {
+		l.errorf("proxy_address", "proxy_address is required")
+	} else if _, host := StripEmail(conf.ProxyAddress); host == "" {
+		l.errorf("proxy_address", "proxy_address %q is not an email address", conf.ProxyAddress)
+	}
+	if conf.ProxyEnvelope == "" {
+		l.errorf("proxy_envelope", "proxy_envelope is required")
+	}
+
+	if len(conf.Upstream) == 0 {
+		l.errorf("upstream", "at least one upstream is required")
+	}
+	l.checkPool("upstream", conf.Upstream)
+	for name, list := range conf.Upstreams {
+		if len(list) == 0 {
+			l.errorf("upstreams."+name, "upstream pool %q is empty", name)
+		}
+		l.checkPool("upstreams."+name, list)
+	}
+	l.checkHealth(conf.Health)
+	l.checkRoutes(conf.Allocation.Routes, conf.Upstreams)
+
+	if len(conf.Listeners) == 0 {
+		l.errorf("listeners", "at least one listener is required")
+	}
+	submission := false
+	addrs := map[string]bool{}
+	for n, ln := range conf.Listeners {
+		key := "listeners." + strconv.Itoa(n)
+		l.checkListener(key, ln)
+		if a := ln.Address(); addrs[a] {
+			l.errorf(key+".port", "listener address %s is used more than once", a)
+		} else {
+			addrs[a] = true
+		}
+		if ln.Role != RoleMX {
+			submission = true
+		}
+	}
+
+	names := map[string]bool{}
+	for n, u := range conf.Users {
+		key := "users." + strconv.Itoa(n)
+		switch {
+		case u.Name == "":
+			l.errorf(key, "user without name")
+			continue
+		case names[u.Name]:
+			l.errorf(key+".name", "duplicate user %q", u.Name)
+		case u.PlainPassword == "" && u.Password == "":
+			l.errorf(key, "user %q has no password", u.Name)
+		case u.PlainPassword != "" && u.Password != "":
+			l.errorf(key+".password_hash", "user %q has both password and password_hash", u.Name)
+		case u.Password != "":
+			if err := checkHash(u.Password); err != nil {
+				l.errorf(key+".password_hash", "user %q: %s", u.Name, err)
+			}
+		}
+		names[u.Name] = true
+		l.checkSenders(key+".allowed_from", u.AllowedFrom)
+		if u.MaxMessageBytes < 0 {
+			l.errorf(key+".max_message_bytes", "%s.max_message_bytes must not be negative", key)
+		}
+	}
+
+	if auth := "users"; len(conf.Users) > 0 || conf.UserStore != nil {
+		if conf.UserStore != nil {
+			auth = "htpasswd"
+			if len(conf.Users) > 0 {
+				l.errorf(auth, "htpasswd and users can't be used together")
+			}
+		}
+		if !submission {
+			l.errorf(auth, "%s is configured but there is no submission listener", auth)
+		}
+		if conf.DkimPrivate == "" {
+			l.errorf(auth, "%s is configured but dkim.private is not set", auth)
+		}
+	}
+
+	l.checkLockout(conf.Lockout)
+	if conf.Spool != (SpoolSetting{}) {
+		l.checkSpool(conf.Spool)
+	}
+	if conf.SRS.Domain != "" || len(conf.SRS.Secrets) > 0 {
+		l.checkSRS(conf.SRS)
+	}
+	l.checkDkim(conf.DkimDomain, conf.DkimSelector, conf.DkimPrivate)
+
+	all := []PolicyAction{ActionAccept, ActionTag, ActionTempfail, ActionReject}
+	l.checkAction("spf.fail", conf.SPF.Fail, all...)
+	l.checkAction("spf.softfail", conf.SPF.Softfail, all...)
+	l.checkAction("spf.permerror", conf.SPF.PermError, all...)
+	l.checkAction("spf.temperror", conf.SPF.TempError, all...)
+	l.checkAction("spf.none", conf.SPF.None, all...)
+
+	if conf.Greylist.Enabled {
+		l.checkGreylist(conf.Greylist)
+	}
+	l.checkRateLimits("rate_limit.per_ip", conf.RateLimit.PerIP)
+	l.checkRateLimits("rate_limit.per_network", conf.RateLimit.PerNetwork)
+	l.checkAction("dkim_verify.policy", conf.DKIMVerify.Policy, ActionAccept, ActionTag, ActionReject)
+	l.checkSpam(conf.Spam)
+
+	l.checkAction("virus.action", conf.Virus.Action, ActionReject, ActionQuarantine, ActionStrip)
+	l.checkAction("virus.default_action", conf.Virus.DefaultAction, ActionAccept, ActionTempfail)
+	if _, host := StripEmail(conf.QuarantineTo); conf.QuarantineTo != "" && host == "" {
+		l.errorf("quarantine_to", "quarantine_to %q is not an email address", conf.QuarantineTo)
+	}
+	// Without quarantine_to an infected message would only be marked and
+	// still reach its recipients.
+	if conf.Virus.Action == ActionQuarantine && conf.QuarantineTo == "" {
+		l.errorf("virus.action", "virus.action quarantine requires quarantine_to")
+	}
+}
+
+func (l *configLoader) buildSpool(fs *fileSpool) SpoolSetting {
+	def := DefaultSpool
+	return SpoolSetting{
+		Dir:          fs.Dir,
+		MaxLifetime:  l.duration("spool.max_lifetime", fs.MaxLifetime, def.MaxLifetime),
+		RetryBase:    l.duration("spool.retry_base", fs.RetryBase, def.RetryBase),
+		RetryMax:     l.duration("spool.retry_max", fs.RetryMax, def.RetryMax),
+		DelayWarning: l.duration("spool.delay_warning", fs.DelayWarning, def.DelayWarning),
+	}
+}
+
+func (l *configLoader) checkSpool(sp SpoolSetting) {
+	if sp.Dir == "" {
+		l.errorf("spool.dir", "spool.dir is required")
+	}
+	if sp.RetryBase > sp.RetryMax {
+		l.errorf("spool.retry_base", "spool.retry_base is larger than spool.retry_max")
+	}
+	if sp.RetryMax > sp.MaxLifetime {
+		l.errorf("spool.retry_max", "spool.retry_max is larger than spool.max_lifetime")
+	}
+}
+
+func (l *configLoader) checkSRS(srs SRSSetting) {
+	if srs.Domain == "" {
+		l.errorf("srs.domain", "srs.domain is required")
+	}
+	if len(srs.Secrets) == 0 {
+		l.errorf("srs.secrets", "srs.secrets is required")
+	}
+	for n, secret := range srs.Secrets {
+		if len(secret) < 16 {
+			l.errorf("srs.secrets."+strconv.Itoa(n), "srs secret is shorter than 16 characters")
+		}
+	}
+	if srs.MaxAge < 0 {
+		l.errorf("srs.max_age", "srs.max_age must not be negative")
+	}
+	if srs.MaxAge > 1000 {
+		l.errorf("srs.max_age", "srs.max_age can't be more than 1000 days")
+	}
+}
+
+func (l *configLoader) checkSenders(key string, list []string) {
+	for n, a := range list {
+		a = strings.TrimPrefix(strings.TrimSpace(a), "@")
+		if a == "" || strings.ContainsAny(a, " <>") {
+			l.errorf(key+"."+strconv.Itoa(n), "%q is not an address or domain", list[n])
+		}
+	}
+}
+
+func (l *configLoader) duration(key, s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		l.errorf(key, "%s: %s", key, err)
+		return def
+	}
+	if d < 0 {
+		l.errorf(key, "%s must not be negative", key)
+	}
+	return d
+}
+
+func (l *configLoader) buildLockout(fl *fileLockout) LockoutSetting {
+	def := DefaultLockout
+	return LockoutSetting{
+		MaxUserFailures: fl.MaxUserFailures,
+		MaxIPFailures:   fl.MaxIPFailures,
+		Window:          l.duration("lockout.window", fl.Window, def.Window),
+		Duration:        l.duration("lockout.duration", fl.Duration, def.Duration),
+		BaseDelay:       l.duration("lockout.base_delay", fl.BaseDelay, def.BaseDelay),
+		MaxDelay:        l.duration("lockout.max_delay", fl.MaxDelay, def.MaxDelay),
+	}
+}
+
+func (l *configLoader) checkLockout(lo LockoutSetting) {
+	if lo.MaxUserFailures < 0 {
+		l.errorf("lockout.max_user_failures", "lockout.max_user_failures must not be negative")
+	}
+	if lo.MaxIPFailures < 0 {
+		l.errorf("lockout.max_ip_failures", "lockout.max_ip_failures must not be negative")
+	}
+	if lo.BaseDelay > lo.MaxDelay {
+		l.errorf("lockout.base_delay", "lockout.base_delay is larger than lockout.max_delay")
+	}
+	if (lo.MaxUserFailures > 0 || lo.MaxIPFailures > 0) && lo.Duration == 0 {
+		l.errorf("lockout.duration", "lockout.duration must be set when failures are limited")
+	}
+}
+
+func (l *configLoader) buildUpstream(key string, fu fileUpstream) Upstream {
+	up := Upstream{
+		Addr:     fu.Addr,
+		LMTP:     fu.LMTP,
+		Host:     fu.Host,
+		Priority: fu.Priority,
+		Weight:   fu.Weight,
+	}
+
+	switch strings.ToLower(fu.Security) {
+	case "", "starttls":
+		up.Security = SecurityStartTLS
+	case "tls":
+		up.Security = SecurityTLS
+	case "none":
+		up.Security = SecurityNone
+	default:
+		l.errorf(key+".security", "unknown %s.security %q, use starttls, tls or none", key, fu.Security)
+	}
+
+	if up.LMTP && fu.Security == "" {
+		up.Security = SecurityNone
+	}
+	if up.Security != SecurityNone {
+		up.TLSConfig = &tls.Config{ServerName: up.Host}
+	}
+
+	return up
+}
+
+func (l *configLoader) checkUpstream(key string, up Upstream) {
+	if up.Addr == "" {
+		l.errorf(key+".addr", "%s.addr is required", key)
+	}
+	if up.Weight < 0 {
+		l.errorf(key+".weight", "%s.weight must not be negative", key)
+	}
+	if up.LMTP && up.Security != SecurityNone {
+		l.errorf(key+".security", "%s.lmtp doesn't support TLS, set %s.security to none", key, key)
+	}
+}
+
+func (l *configLoader) buildPool(key string, list []fileUpstream) []Upstream {
+	var pool []Upstream
+	for n, fu := range list {
+		pool = append(pool, l.buildUpstream(key+"."+strconv.Itoa(n), fu))
+	}
+	return pool
+}
+
+func (l *configLoader) checkPool(key string, pool []Upstream) {
+	seen := map[string]bool{}
+	for n, up := range pool {
+		k := key + "." + strconv.Itoa(n)
+		l.checkUpstream(k, up)
+		if seen[upstreamKey(up)] {
+			l.errorf(k+".addr", "upstream %s is listed more than once", up.Addr)
+		}
+		seen[upstreamKey(up)] = true
+	}
+}
+
+func (l *configLoader) buildHealth(fh *fileHealth) HealthSetting {
+	def := DefaultHealth
+	return HealthSetting{
+		Interval:  l.duration("health.interval", fh.Interval, def.Interval),
+		Threshold: fh.Threshold,
+		Cooldown:  l.duration("health.cooldown", fh.Cooldown, def.Cooldown),
+	}
+}
+
+func (l *configLoader) checkHealth(h HealthSetting) {
+	if h.Threshold < 0 {
+		l.errorf("health.threshold", "health.threshold must not be negative")
+	}
+	if h.Threshold > 0 && h.Cooldown == 0 {
+		l.errorf("health.cooldown", "health.cooldown must be set when health.threshold is")
+	}
+}
+
+func (l *configLoader) buildRoutes(fr []fileRoute) []Route {
+	var routes []Route
+	for _, r := range fr {
+		routes = append(routes, Route{
+			Pattern:      normalizeKey(r.Match),
+			Destinations: r.To,
+			Upstream:     r.Upstream,
+			Envelope:     r.Envelope,
+		})
+	}
+	return routes
+}
+
+func (l *configLoader) checkRoutes(routes []Route, upstreams map[string][]Upstream) {
+	seen := map[string]bool{}
+	for n, r := range routes {
+		key := "routes." + strconv.Itoa(n)
+		if r.Pattern == "" {
+			l.errorf(key, "route without match")
+			continue
+		}
+		if seen[r.Pattern] {
+			l.errorf(key+".match", "duplicate route for %q", r.Pattern)
+		}
+		seen[r.Pattern] = true
+
+		if _, ok := upstreams[r.Upstream]; r.Upstream != "" && !ok {
+			l.errorf(key+".upstream", "route %q uses unknown upstream %q", r.Pattern, r.Upstream)
+		}
+		for i, d := range r.Destinations {
+			if _, host := StripEmail(d); host == "" {
+				l.errorf(key+".to."+strconv.Itoa(i), "route %q destination %q is not an email address", r.Pattern, d)
+			}
+		}
+	}
+}
+
+func (l *configLoader) buildListener(key string, fl fileListener) Listener {
+	ln := Listener{
+		Addr:         fl.Addr,
+		Port:         fl.Port,
+		ReadTimeout:  fl.ReadTimeout,
+		WriteTimeout: fl.WriteTimeout,
+	}
+
+	switch strings.ToLower(fl.Role) {
+	case "", "mx":
+		ln.Role = RoleMX
+	case "submission":
+		ln.Role = RoleSubmission
+	case "submissions":
+		ln.Role = RoleSubmissions
+	default:
+		l.errorf(key+".role", "unknown %s.role %q, use mx, submission or submissions", key, fl.Role)
+	}
+
+	ln.MaxMessageBytes = DefaultMaxMessageBytes
+	if fl.MaxMessageBytes != nil {
+		ln.MaxMessageBytes = *fl.MaxMessageBytes
+	}
+	for n, fm := range fl.Milters {
+		ln.Milters = append(ln.Milters, l.buildMilter(key+".milters."+strconv.Itoa(n), fm))
+	}
+
+	switch {
+	case fl.TlsCert == "" && fl.TlsKey == "":
+	case fl.TlsCert == "":
+		l.errorf(key+".tls_key", "%s.tls_key set without %s.tls_cert", key, key)
+	case fl.TlsKey == "":
+		l.errorf(key+".tls_cert", "%s.tls_cert set without %s.tls_key", key, key)
+	default:
+		cert, err := tls.LoadX509KeyPair(fl.TlsCert, fl.TlsKey)
+		if err != nil {
+			l.errorf(key+".tls_cert", "%s", err)
+			break
+		}
+		ln.TlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return ln
+}
+
+func (l *configLoader) checkListener(key string, ln Listener) {
+	if ln.Port == 0 {
+		l.errorf(key+".port", "%s.port is required", key)
+	} else if ln.Port < 0 || ln.Port > 65535 {
+		l.errorf(key+".port", "%s.port %d is out of range", key, ln.Port)
+	}
+	if ln.ReadTimeout < 0 {
+		l.errorf(key+".read_timeout", "%s.read_timeout must not be negative", key)
+	}
+	if ln.WriteTimeout < 0 {
+		l.errorf(key+".write_timeout", "%s.write_timeout must not be negative", key)
+	}
+	if ln.MaxMessageBytes < 0 {
+		l.errorf(key+".max_message_bytes", "%s.max_message_bytes must not be negative", key)
+	}
+	for n, ms := range ln.Milters {
+		k := key + ".milters." + strconv.Itoa(n)
+		if ms.Address == "" {
+			l.errorf(k+".address", "%s.address is required", k)
+		}
+		l.checkAction(k+".default_action", ms.DefaultAction, ActionAccept, ActionTempfail, ActionReject)
+	}
+	if ln.Role != RoleMX && (ln.TlsConfig == nil || len(ln.TlsConfig.Certificates) == 0) {
+		l.errorf(key+".role", "%s.role %s requires tls_cert and tls_key", key, ln.Role)
+	}
+}
+
+func (l *configLoader) checkDkim(domain, selector, private string) {
+	if private == "" {
+		if domain != "" {
+			l.errorf("dkim.domain", "dkim.domain set without dkim.private")
+		}
+		if selector != "" {
+			l.errorf("dkim.selector", "dkim.selector set without dkim.private")
+		}
+		return
+	}
+
+	if domain == "" {
+		l.errorf("dkim.private", "dkim.private set without dkim.domain")
+	}
+	if selector == "" {
+		l.errorf("dkim.private", "dkim.private set without dkim.selector")
+	}
+	if _, err := readPrivateKey(private); err != nil {
+		l.errorf("dkim.private", "%s: %s", private, err)
+	}
+}
+
+func (l *configLoader) buildSpf(fs *fileSpf) SPFSetting {
+	def := DefaultSPF
+	all := []PolicyAction{ActionAccept, ActionTag, ActionTempfail, ActionReject}
+	return SPFSetting{
+		Fail:      l.policyAction("spf.fail", fs.Fail, def.Fail, all...),
+		Softfail:  l.policyAction("spf.softfail", fs.Softfail, def.Softfail, all...),
+		PermError: l.policyAction("spf.permerror", fs.PermError, def.PermError, all...),
+		TempError: l.policyAction("spf.temperror", fs.TempError, def.TempError, all...),
+		None:      l.policyAction("spf.none", fs.None, def.None, all...),
+	}
+}
+
+func (l *configLoader) buildGreylist(fg *fileGreylist) GreylistSetting {
+	def := DefaultGreylist
+	g := GreylistSetting{
+		Enabled:        true,
+		Delay:          l.duration("greylist.delay", fg.Delay, def.Delay),
+		Window:         l.duration("greylist.window", fg.Window, def.Window),
+		Lifetime:       l.duration("greylist.lifetime", fg.Lifetime, def.Lifetime),
+		WhitelistAfter: def.WhitelistAfter,
+		ExemptNetworks: l.networks("greylist.exempt_networks", fg.ExemptNetworks),
+		ExemptDomains:  toSet(fg.ExemptDomains),
+		ExemptSPFPass:  fg.ExemptSPFPass,
+	}
+	if fg.WhitelistAfter != nil {
+		g.WhitelistAfter = *fg.WhitelistAfter
+	}
+	return g
+}
+
+func (l *configLoader) checkGreylist(g GreylistSetting) {
+	if g.Delay >= g.Window {
+		l.errorf("greylist.delay", "greylist.delay must be shorter than greylist.window")
+	}
+	if g.WhitelistAfter < 0 {
+		l.errorf("greylist.whitelist_after", "greylist.whitelist_after must not be negative")
+	}
+}
+
+func (l *configLoader) checkRateLimits(key string, r RateLimits) {
+	if r.Connections < 0 {
+		l.errorf(key+".connections", "%s.connections must not be negative", key)
+	}
+	if r.MessagesPerMinute < 0 {
+		l.errorf(key+".messages_per_minute", "%s.messages_per_minute must not be negative", key)
+	}
+	if r.RecipientsPerHour < 0 {
+		l.errorf(key+".recipients_per_hour", "%s.recipients_per_hour must not be negative", key)
+	}
+}
+
+// networks parses a list of CIDRs, a plain address standing for itself.
+func (l *configLoader) networks(key string, list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for n, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			l.errorf(key+"."+strconv.Itoa(n), "%q is not a network", list[n])
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+func (l *configLoader) buildSpam(fs *fileSpam) SpamSetting {
+	sp := SpamSetting{
+		Tag:           fs.Tag,
+		Subject:       fs.Subject,
+		SubjectTag:    fs.SubjectTag,
+		Quarantine:    fs.Quarantine,
+		Reject:        fs.Reject,
+		DefaultAction: l.policyAction("spam.default_action", fs.DefaultAction, ActionAccept, ActionAccept, ActionTempfail),
+	}
+	if sp.SubjectTag == "" {
+		sp.SubjectTag = DefaultSpamSubjectTag
+	}
+	timeout := l.duration("spam.timeout", fs.Timeout, DefaultSpamTimeout)
+	if fs.Address == "" {
+		l.errorf("spam.address", "spam.address is required")
+		return sp
+	}
+	switch strings.ToLower(fs.Type) {
+	case "spamd":
+		network, addr, err := ParseScannerAddress(fs.Address)
+		if err != nil {
+			l.errorf("spam.address", "spam.address %q: %s", fs.Address, err)
+		}
+		sp.Scanner = &SpamdScanner{Network: network, Address: addr, User: fs.User, Timeout: timeout}
+	case "rspamd":
+		u := fs.Address
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			u = "http://" + u
+		}
+		sp.Scanner = &RspamdScanner{URL: u, Password: fs.Password, Timeout: timeout}
+	default:
+		l.errorf("spam.type", "spam.type must be one of spamd, rspamd")
+	}
+	return sp
+}
+
+func (l *configLoader) checkSpam(sp SpamSetting) {
+	for _, t := range []struct {
+		key   string
+		value float64
+	}{{"tag", sp.Tag}, {"subject", sp.Subject}, {"quarantine", sp.Quarantine}, {"reject", sp.Reject}} {
+		if t.value < 0 {
+			l.errorf("spam."+t.key, "spam.%s must not be negative", t.key)
+		}
+	}
+	l.checkAction("spam.default_action", sp.DefaultAction, ActionAccept, ActionTempfail)
+}
+
+func (l *configLoader) buildVirus(fv *fileVirus) VirusSetting {
+	v := VirusSetting{
+		Action:        l.policyAction("virus.action", fv.Action, ActionReject, ActionReject, ActionQuarantine, ActionStrip),
+		DefaultAction: l.policyAction("virus.default_action", fv.DefaultAction, ActionTempfail, ActionAccept, ActionTempfail),
+	}
+	timeout := l.duration("virus.timeout", fv.Timeout, DefaultClamdTimeout)
+	if fv.Address == "" {
+		l.errorf("virus.address", "virus.address is required")
+		return v
+	}
+	network, addr, err := ParseScannerAddress(fv.Address)
+	if err != nil {
+		l.errorf("virus.address", "virus.address %q: %s", fv.Address, err)
+	}
+	v.Scanner = &ClamdScanner{Network: network, Address: addr, Timeout: timeout}
+	return v
+}
+
+func (l *configLoader) buildMilter(key string, fm fileMilter) MilterSetting {
+	ms := MilterSetting{
+		Name:    fm.Name,
+		Timeout: l.duration(key+".timeout", fm.Timeout, DefaultMilterTimeout),
+		DefaultAction: l.policyAction(key+".default_action", fm.DefaultAction, ActionTempfail,
+			ActionAccept, ActionTempfail, ActionReject),
+	}
+	if fm.Address == "" {
+		return ms
+	}
+	network, addr, err := ParseMilterAddress(fm.Address)
+	if err != nil {
+		l.errorf(key+".address", "%s.address %q: %s", key, fm.Address, err)
+	}
+	ms.Network, ms.Address = network, addr
+	if ms.Name == "" {
+		ms.Name = fm.Address
+	}
+	return ms
+}
+
+// policyAction parses s as one of allowed, returning def when s is empty.
+func (l *configLoader) policyAction(key, s string, def PolicyAction, allowed ...PolicyAction) PolicyAction {
+	if s == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if PolicyAction(strings.ToLower(s)) == a {
+			return a
+		}
+	}
+
+	l.errorf(key, "%s must be one of %s", key, actionNames(allowed))
+	return def
+}
+
+// checkAction reports an action set to something else than one of allowed,
+// unset stands for the default.
+func (l *configLoader) checkAction(key string, a PolicyAction, allowed ...PolicyAction) {
+	if a == "" {
+		return
+	}
+	for _, ok := range allowed {
+		if a == ok {
+			return
+		}
+	}
+	l.errorf(key, "%s %q is not one of %s", key, a, actionNames(allowed))
+}
+
+func actionNames(list []PolicyAction) string {
+	names := make([]string, len(list))
+	for n, a := range list {
+		names[n] = string(a)
+	}
+	return strings.Join(names, ", ")
+}
+
+func toSet(list []string) map[string]bool {
+	m := make(map[string]bool, len(list))
+	for _, v := range list {
+		m[normalizeKey(v)] = true
+	}
+	return m
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	baseYAML = `server_name: mx.example.org
+proxy_address: fwd@example.org
+proxy_envelope: proxy@example.org
+upstream:
+  - addr: 127.0.0.1:25
+    security: none
+listeners:
+  - port: 25
+`
+	baseTOML = `server_name = "mx.example.org"
+proxy_address = "fwd@example.org"
+proxy_envelope = "proxy@example.org"
+
+[[upstream]]
+addr = "127.0.0.1:25"
+security = "none"
+
+[[listeners]]
+port = 25
+`
+)
+
+func loadTestConfig(t *testing.T, name, content string) (string, *Config, error) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(path)
+	return path, conf, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		// err is the expected error after "path:", empty for none.
+		err string
+	}{
+		{"yaml valid", "c.yaml", baseYAML, ""},
+		{"yaml bad type", "c.yaml", baseYAML + "    read_timeout: soon\n", "9: cannot unmarshal !!str `soon` into int"},
+		{"yaml unknown key", "c.yaml", baseYAML + "colour: red\n", "9: field colour not found"},
+		{"yaml unknown nested key", "c.yaml", baseYAML + "    colour: red\n", "9: field colour not found"},
+		{"yaml unknown role", "c.yaml", baseYAML + "    role: relay\n", `9: unknown listeners.0.role "relay"`},
+		{"yaml tls_key without tls_cert", "c.yaml", baseYAML + "    tls_key: /etc/ssl/mx.key\n", "9: listeners.0.tls_key set without listeners.0.tls_cert"},
+		{"yaml duplicate listener", "c.yaml", baseYAML + "  - port: 25\n", "9: listener address :25 is used more than once"},
+		{"yaml greylist delay", "c.yaml", baseYAML + "greylist:\n  delay: 2h\n  window: 1h\n", "10: greylist.delay must be shorter than greylist.window"},
+		{"yaml spool retries", "c.yaml", baseYAML + "spool:\n  dir: /var/spool/fujinami\n  retry_base: 2h\n  retry_max: 1h\n", "11: spool.retry_base is larger than spool.retry_max"},
+		{"yaml dkim without private", "c.yaml", baseYAML + "dkim:\n  domain: example.org\n", "10: dkim.domain set without dkim.private"},
+		{"yaml users without submission", "c.yaml", baseYAML + "users:\n  - name: alice\n    password: secret\n", "9: users is configured but there is no submission listener"},
+		{"yaml unknown route upstream", "c.yaml", baseYAML + "routes:\n  - match: example.org\n    upstream: backup\n", `11: route "example.org" uses unknown upstream "backup"`},
+		{"yaml bad duration", "c.yaml", baseYAML + "lockout:\n  window: soon\n", `10: lockout.window: time: invalid duration`},
+
+		{"toml valid", "c.toml", baseTOML, ""},
+		{"toml bad type", "c.toml", baseTOML + "read_timeout = \"soon\"\n", "11: listeners.read_timeout: incompatible types"},
+		{"toml unknown key", "c.toml", baseTOML + "colour = \"red\"\n", `11: unknown key "listeners.colour"`},
+		{"toml unknown key in second table", "c.toml", baseTOML + "\n[[upstream]]\naddr = \"127.0.0.1:26\"\ncolour = \"red\"\n", `14: unknown key "upstream.colour"`},
+		{"toml unknown role", "c.toml", baseTOML + "role = \"relay\"\n", `11: unknown listeners.0.role "relay"`},
+		{"toml tls_key without tls_cert", "c.toml", baseTOML + "tls_key = \"/etc/ssl/mx.key\"\n", "11: listeners.0.tls_key set without listeners.0.tls_cert"},
+		{"toml duplicate listener", "c.toml", baseTOML + "\n[[listeners]]\nport = 25\n", "13: listener address :25 is used more than once"},
+		{"toml greylist delay", "c.toml", baseTOML + "\n[greylist]\ndelay = \"2h\"\nwindow = \"1h\"\n", "13: greylist.delay must be shorter than greylist.window"},
+		{"toml spool retries", "c.toml", baseTOML + "\n[spool]\ndir = \"/var/spool/fujinami\"\nretry_base = \"2h\"\nretry_max = \"1h\"\n", "14: spool.retry_base is larger than spool.retry_max"},
+		{"toml unknown route upstream", "c.toml", baseTOML + "\n[[routes]]\nmatch = \"example.org\"\nupstream = \"backup\"\n", `14: route "example.org" uses unknown upstream "backup"`},
+		{"toml syntax", "c.toml", baseTOML + "port = = 25\n", "11: listeners.port: expected value but found"},
+
+		{"unknown format", "c.ini", baseYAML, "unknown config format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, conf, err := loadTestConfig(t, tt.file, tt.content)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if conf.Listeners[0].Port != 25 || conf.Upstream[0].Security != SecurityNone {
+					t.Errorf("config = %+v", conf)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %s", tt.err)
+			}
+			sep := ":"
+			if tt.file == "c.ini" {
+				sep = ": "
+			}
+			if !strings.Contains(err.Error(), path+sep+tt.err) {
+				t.Errorf("err = %v\nwant %s%s%s", err, path, sep, tt.err)
+			}
+		})
+	}
+}
+
+// TestValidate checks that Reload refuses what LoadConfig refuses.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"unchanged", func(c *Config) {}, ""},
+		{"no port", func(c *Config) { c.Listeners[0].Port = 0 }, "listeners.0.port is required"},
+		{"greylist delay", func(c *Config) {
+			c.Greylist = GreylistSetting{Enabled: true, Delay: 2 * time.Hour, Window: time.Hour}
+		}, "greylist.delay must be shorter than greylist.window"},
+		{"submission without certificate", func(c *Config) { c.Listeners[0].Role = RoleSubmission }, "listeners.0.role submission requires tls_cert and tls_key"},
+		{"lmtp over TLS", func(c *Config) { c.Upstream[0].LMTP, c.Upstream[0].Security = true, SecurityTLS }, "upstream.0.lmtp doesn't support TLS"},
+		{"unknown action", func(c *Config) { c.SPF.Fail = "drop" }, `spf.fail "drop" is not one of`},
+		{"quarantine", func(c *Config) { c.Virus.Action = ActionQuarantine }, "virus.action quarantine requires quarantine_to"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, conf, err := loadTestConfig(t, "c.yaml", baseYAML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			be := NewBackend(conf)
+			next := *conf
+			next.Listeners = append([]Listener(nil), conf.Listeners...)
+			next.Upstream = append([]Upstream(nil), conf.Upstream...)
+			tt.change(&next)
+
+			err = be.Reload(&next)
+			if tt.err == "" {
+				if err != nil || be.CurrentConfig() != &next {
+					t.Fatalf("Reload = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Reload = %v, want %s", err, tt.err)
+			}
+			if be.CurrentConfig() != conf {
+				t.Error("rejected config put in service")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"gosmtp/src/store"
+)
+
+type LockoutSetting struct {
+	// MaxUserFailures and MaxIPFailures are the failed attempts allowed
+	// within Window before the user name or remote address is locked out.
+	MaxUserFailures int
+	MaxIPFailures   int
+	Window          time.Duration
+	Duration        time.Duration
+	// Each failure waits BaseDelay, doubled per previous failure, up to
+	// MaxDelay before the reply is sent.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultLockout = LockoutSetting{
+	MaxUserFailures: 5,
+	MaxIPFailures:   20,
+	Window:          15 * time.Minute,
+	Duration:        30 * time.Minute,
+	BaseDelay:       500 * time.Millisecond,
+	MaxDelay:        8 * time.Second,
+}
+
+func (l LockoutSetting) orDefault() LockoutSetting {
+	if l == (LockoutSetting{}) {
+		return DefaultLockout
+	}
+	return l
+}
+
+func (l LockoutSetting) delay(count int) time.Duration {
+	d := l.BaseDelay
+	for i := 1; i < count && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if l.MaxDelay > 0 && d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+func ipKey(state *smtp.ConnectionState) string {
+	return "ip:" + StripPort(state.RemoteAddr)
+}
+
+func lockedOut(l LockoutSetting, state *smtp.ConnectionState, username string) bool {
+	now := time.Now()
+	if store.GetFailures(userKey(username), now, l.Window).Locked(now) {
+		log.Printf("[lockout] refused %s from %s: user locked\n", username, state.RemoteAddr)
+		return true
+	}
+	if store.GetFailures(ipKey(state), now, l.Window).Locked(now) {
+		log.Printf("[lockout] refused %s from %s: address locked\n", username, state.RemoteAddr)
+		return true
+	}
+	return false
+}
+
+// loginFailed records the failure for both the user name and the remote
+// address, locks them out once their limit is reached and then sleeps for
+// the backoff delay.
+func loginFailed(l LockoutSetting, state *smtp.ConnectionState, username string) {
+	now := time.Now()
+
+	uf := store.AddFailure(userKey(username), now, l.Window)
+	if l.MaxUserFailures > 0 && uf.Count >= l.MaxUserFailures && !uf.Locked(now) {
+		store.Lock(userKey(username), now.Add(l.Duration))
+		log.Printf("[lockout] user %s locked for %s after %d failures, last from %s\n", username, l.Duration, uf.Count, state.RemoteAddr)
+	}
+
+	ipf := store.AddFailure(ipKey(state), now, l.Window)
+	if l.MaxIPFailures > 0 && ipf.Count >= l.MaxIPFailures && !ipf.Locked(now) {
+		store.Lock(ipKey(state), now.Add(l.Duration))
+		log.Printf("[lockout] address %s locked for %s after %d failures\n", state.RemoteAddr, l.Duration, ipf.Count)
+	}
+
+	count := uf.Count
+	if ipf.Count > count {
+		count = ipf.Count
+	}
+	time.Sleep(l.delay(count))
+}
+
+func loginSucceeded(state *smtp.ConnectionState, username string) {
+	store.ClearFailures(userKey(username))
+	store.ClearFailures(ipKey(state))
+}
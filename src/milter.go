@@ -0,0 +1,658 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// MilterSetting is one milter of a listener. Network and Address are
+// passed to net.Dial. DefaultAction decides what happens to mail while the
+// milter can't be reached or misbehaves: ActionAccept skips it,
+// ActionTempfail and ActionReject refuse the mail.
+type MilterSetting struct {
+	Name          string
+	Network       string
+	Address       string
+	Timeout       time.Duration
+	DefaultAction PolicyAction
+}
+
+const DefaultMilterTimeout = 30 * time.Second
+
+// Sendmail milter protocol version 6, see libmilter/mfdef.h.
+const milterVersion = 6
+
+const (
+	smfiAddHeaders = 0x01
+	smfiChgBody    = 0x02
+	smfiChgHeaders = 0x10
+	smfiQuarantine = 0x20
+
+	milterActions = smfiAddHeaders | smfiChgBody | smfiChgHeaders | smfiQuarantine
+)
+
+const (
+	smfipNoConnect = 1 << iota
+	smfipNoHelo
+	smfipNoMail
+	smfipNoRcpt
+	smfipNoBody
+	smfipNoHeaders
+	smfipNoEOH
+	smfipNoReplyHeader
+	smfipNoUnknown
+	smfipNoData
+	smfipSkip
+	smfipRcptRejected
+	smfipNoReplyConnect
+	smfipNoReplyHelo
+	smfipNoReplyMail
+	smfipNoReplyRcpt
+	smfipNoReplyData
+	smfipNoReplyUnknown
+	smfipNoReplyEOH
+	smfipNoReplyBody
+
+	// The steps we can leave out or send without waiting for a reply.
+	milterProtocol = smfipNoConnect | smfipNoHelo | smfipNoMail | smfipNoRcpt |
+		smfipNoBody | smfipNoHeaders | smfipNoEOH | smfipNoReplyHeader |
+		smfipNoUnknown | smfipNoData | smfipSkip | smfipNoReplyConnect |
+		smfipNoReplyHelo | smfipNoReplyMail | smfipNoReplyRcpt |
+		smfipNoReplyData | smfipNoReplyUnknown | smfipNoReplyEOH |
+		smfipNoReplyBody
+)
+
+// Commands sent to the milter and the replies it can give.
+const (
+	smficAbort   = 'A'
+	smficBody    = 'B'
+	smficConnect = 'C'
+	smficMacro   = 'D'
+	smficEOB     = 'E'
+	smficHelo    = 'H'
+	smficHeader  = 'L'
+	smficMail    = 'M'
+	smficEOH     = 'N'
+	smficOptNeg  = 'O'
+	smficQuit    = 'Q'
+	smficRcpt    = 'R'
+	smficData    = 'T'
+
+	smfirAddHeader  = 'h'
+	smfirInsHeader  = 'i'
+	smfirChgHeader  = 'm'
+	smfirReplBody   = 'b'
+	smfirQuarantine = 'q'
+	smfirAccept     = 'a'
+	smfirContinue   = 'c'
+	smfirDiscard    = 'd'
+	smfirReject     = 'r'
+	smfirTempfail   = 't'
+	smfirReplyCode  = 'y'
+	smfirProgress   = 'p'
+	smfirSkip       = 's'
+)
+
+const milterChunk = 65535
+
+var errMilterProtocol = errors.New("milter protocol error")
+
+// milterClient is the connection to one milter for the length of an SMTP
+// session.
+type milterClient struct {
+	MilterSetting
+	conn     net.Conn
+	r        *bufio.Reader
+	actions  uint32
+	protocol uint32
+	// accepted is set when the milter wants nothing more of the current
+	// message, broken when it failed and is skipped.
+	accepted bool
+	broken   bool
+}
+
+func dialMilter(ms MilterSetting) (*milterClient, error) {
+	timeout := ms.Timeout
+	if timeout == 0 {
+		timeout = DefaultMilterTimeout
+	}
+	conn, err := net.DialTimeout(ms.Network, ms.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	mc := &milterClient{MilterSetting: ms, conn: conn, r: bufio.NewReader(conn)}
+	mc.Timeout = timeout
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActions)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	if err := mc.write(smficOptNeg, data); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	code, data, err := mc.read()
+	if err == nil && (code != smficOptNeg || len(data) < 12) {
+		err = errMilterProtocol
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if v := binary.BigEndian.Uint32(data); v < 2 || v > milterVersion {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported milter version %d", v)
+	}
+	mc.actions = binary.BigEndian.Uint32(data[4:]) & milterActions
+	mc.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocol
+	return mc, nil
+}
+
+func (mc *milterClient) write(code byte, data []byte) error {
+	mc.conn.SetWriteDeadline(time.Now().Add(mc.Timeout))
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(len(data)+1))
+	hdr[4] = code
+	if _, err := mc.conn.Write(append(hdr, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mc *milterClient) read() (byte, []byte, error) {
+	mc.conn.SetReadDeadline(time.Now().Add(mc.Timeout))
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(mc.r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr)
+	if n == 0 || n > 1<<20 {
+		return 0, nil, errMilterProtocol
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(mc.r, data); err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+// macros sends macro values for the command that follows.
+func (mc *milterClient) macros(cmd byte, kv ...string) error {
+	data := []byte{cmd}
+	for _, s := range kv {
+		data = append(append(data, s...), 0)
+	}
+	return mc.write(smficMacro, data)
+}
+
+// command sends one step and returns the milter's verdict. A step the
+// milter asked not to get is skipped, one it doesn't reply to continues.
+func (mc *milterClient) command(code byte, skip, noReply uint32, data []byte) (byte, []byte, error) {
+	if mc.protocol&skip != 0 {
+		return smfirContinue, nil, nil
+	}
+	if err := mc.write(code, data); err != nil {
+		return 0, nil, err
+	}
+	if mc.protocol&noReply != 0 {
+		return smfirContinue, nil, nil
+	}
+	for {
+		reply, data, err := mc.read()
+		if err != nil || reply != smfirProgress {
+			return reply, data, err
+		}
+	}
+}
+
+func (mc *milterClient) close() {
+	mc.write(smficQuit, nil)
+	mc.conn.Close()
+}
+
+func cstrings(s ...string) []byte {
+	var b []byte
+	for _, v := range s {
+		b = append(append(b, v...), 0)
+	}
+	return b
+}
+
+// milterChain runs the milters of a listener in order over one SMTP
+// session. A nil chain does nothing.
+type milterChain struct {
+	clients   []*milterClient
+	conf      *Config
+	inMessage bool
+	discard   bool
+}
+
+// openMilters connects to the milters and passes them the connect and
+// HELO steps.
+func openMilters(settings []MilterSetting, conf *Config, state *smtp.ConnectionState) (*milterChain, error) {
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	m := &milterChain{conf: conf}
+	for _, ms := range settings {
+		mc, err := dialMilter(ms)
+		if err != nil {
+			if err := m.failed(ms, err); err != nil {
+				m.Close()
+				return nil, err
+			}
+			continue
+		}
+		m.clients = append(m.clients, mc)
+	}
+
+	host := state.Hostname
+	addr := StripPort(state.RemoteAddr)
+	family, port := byte('U'), uint16(0)
+	if ta, ok := state.RemoteAddr.(*net.TCPAddr); ok {
+		family, port = '4', uint16(ta.Port)
+		if ta.IP.To4() == nil {
+			family = '6'
+		}
+	}
+	connect := append(cstrings(host), family)
+	if family != 'U' {
+		connect = append(connect, byte(port>>8), byte(port))
+		connect = append(connect, cstrings(addr)...)
+	}
+
+	err := m.step(func(mc *milterClient) (byte, []byte, error) {
+		if err := mc.macros(smficConnect, "j", conf.ServerName, "{daemon_name}", conf.Name,
+			"{client_addr}", addr, "{client_name}", host); err != nil {
+			return 0, nil, err
+		}
+		reply, data, err := mc.command(smficConnect, smfipNoConnect, smfipNoReplyConnect, connect)
+		if err != nil || !continues(reply) {
+			return reply, data, err
+		}
+		return mc.command(smficHelo, smfipNoHelo, smfipNoReplyHelo, cstrings(state.Hostname))
+	})
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func continues(reply byte) bool {
+	return reply == smfirContinue || reply == smfirAccept
+}
+
+// failed applies the default action of a milter that can't be used.
+func (m *milterChain) failed(ms MilterSetting, err error) error {
+	log.Printf("[milter] %s: %s, %s\r\n", ms.Name, err, ms.DefaultAction)
+	switch ms.DefaultAction {
+	case ActionReject:
+		return NewMilterRejectError()
+	case ActionAccept:
+		return nil
+	}
+	return NewMilterTempError()
+}
+
+// step runs fn on every milter still interested in the message and turns
+// the first verdict other than continue into the SMTP reply.
+func (m *milterChain) step(fn func(mc *milterClient) (byte, []byte, error)) error {
+	if m == nil || m.discard {
+		return nil
+	}
+	for _, mc := range m.clients {
+		if mc.broken || mc.accepted {
+			continue
+		}
+		reply, data, err := fn(mc)
+		if err != nil {
+			mc.broken = true
+			mc.conn.Close()
+			if err := m.failed(mc.MilterSetting, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.verdict(mc, reply, data); err != nil || m.discard {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *milterChain) verdict(mc *milterClient, reply byte, data []byte) error {
+	switch reply {
+	case smfirContinue, smfirSkip:
+		return nil
+	case smfirAccept:
+		mc.accepted = true
+		return nil
+	case smfirDiscard:
+		log.Printf("[milter] %s: discard\r\n", mc.Name)
+		m.discard = true
+		return nil
+	case smfirReject:
+		log.Printf("[milter] %s: reject\r\n", mc.Name)
+		return NewMilterRejectError()
+	case smfirTempfail:
+		log.Printf("[milter] %s: tempfail\r\n", mc.Name)
+		return NewMilterTempError()
+	case smfirReplyCode:
+		text := strings.TrimRight(string(data), "\x00")
+		log.Printf("[milter] %s: %s\r\n", mc.Name, text)
+		if len(text) < 3 {
+			return NewMilterTempError()
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil || code < 400 || code > 599 {
+			return NewMilterTempError()
+		}
+		return replyError(&textproto.Error{Code: code, Msg: strings.TrimSpace(text[3:])})
+	}
+	log.Printf("[milter] %s: unexpected reply %q\r\n", mc.Name, reply)
+	mc.broken = true
+	mc.conn.Close()
+	return m.failed(mc.MilterSetting, errMilterProtocol)
+}
+
+// Mail starts a message.
+func (m *milterChain) Mail(from, user string) error {
+	if m == nil {
+		return nil
+	}
+	m.inMessage = true
+	m.discard = false
+	for _, mc := range m.clients {
+		mc.accepted = false
+	}
+
+	return m.step(func(mc *milterClient) (byte, []byte, error) {
+		kv := []string{"{mail_addr}", from}
+		if user != "" {
+			kv = append(kv, "{auth_authen}", user)
+		}
+		if err := mc.macros(smficMail, kv...); err != nil {
+			return 0, nil, err
+		}
+		return mc.command(smficMail, smfipNoMail, smfipNoReplyMail, cstrings("<"+from+">"))
+	})
+}
+
+func (m *milterChain) Rcpt(to string) error {
+	return m.step(func(mc *milterClient) (byte, []byte, error) {
+		if err := mc.macros(smficRcpt, "{rcpt_addr}", to); err != nil {
+			return 0, nil, err
+		}
+		return mc.command(smficRcpt, smfipNoRcpt, smfipNoReplyRcpt, cstrings("<"+to+">"))
+	})
+}
+
+// Discarded reports whether a milter asked to drop the message silently.
+func (m *milterChain) Discarded() bool {
+	return m != nil && m.discard
+}
+
+// Data passes msg through the milters one after the other, each seeing the
+// changes of the ones before. It returns the changed message and the
+// reasons milters gave for quarantining it.
+func (m *milterChain) Data(msg []byte) ([]byte, []string, error) {
+	if m == nil {
+		return msg, nil, nil
+	}
+	defer func() { m.inMessage = false }()
+
+	var quarantine []string
+	queueID := strings.ToUpper(strings.Replace(uuid.New().String(), "-", "", -1)[:12])
+	err := m.step(func(mc *milterClient) (byte, []byte, error) {
+		var (
+			reply byte
+			data  []byte
+			err   error
+		)
+		reply, data, err = mc.content(msg, queueID)
+		if err != nil || reply != smfirContinue {
+			return reply, data, err
+		}
+
+		// End of message: the milter sends its changes, then a verdict.
+		var mod messageEdit
+		if err := mc.macros(smficEOB, "i", queueID); err != nil {
+			return 0, nil, err
+		}
+		if err := mc.write(smficEOB, nil); err != nil {
+			return 0, nil, err
+		}
+		for {
+			reply, data, err = mc.read()
+			if err != nil {
+				return 0, nil, err
+			}
+			switch reply {
+			case smfirProgress:
+				continue
+			case smfirAddHeader, smfirInsHeader, smfirChgHeader, smfirReplBody:
+				if err := mod.add(mc, reply, data); err != nil {
+					return 0, nil, err
+				}
+				continue
+			case smfirQuarantine:
+				if mc.actions&smfiQuarantine != 0 {
+					reason := strings.TrimRight(string(data), "\x00")
+					log.Printf("[milter] %s: quarantine %s\r\n", mc.Name, reason)
+					quarantine = append(quarantine, mc.Name+": "+reason)
+				}
+				continue
+			}
+			break
+		}
+		if reply == smfirContinue || reply == smfirAccept {
+			msg = mod.apply(msg)
+		}
+		return reply, data, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, quarantine, nil
+}
+
+// content sends the DATA, header and body steps of msg.
+func (mc *milterClient) content(msg []byte, queueID string) (byte, []byte, error) {
+	if err := mc.macros(smficData, "i", queueID); err != nil {
+		return 0, nil, err
+	}
+	reply, data, err := mc.command(smficData, smfipNoData, smfipNoReplyData, nil)
+	if err != nil || reply != smfirContinue {
+		return reply, data, err
+	}
+
+	fields, body := splitMessage(msg)
+	for _, f := range fields {
+		value := strings.TrimLeft(strings.TrimRight(fieldValue(f), "\r\n"), " \t")
+		value = strings.Replace(value, "\r\n", "\n", -1)
+		reply, data, err = mc.command(smficHeader, smfipNoHeaders, smfipNoReplyHeader, cstrings(fieldName(f), value))
+		if err != nil || reply != smfirContinue {
+			return reply, data, err
+		}
+	}
+	reply, data, err = mc.command(smficEOH, smfipNoEOH, smfipNoReplyEOH, nil)
+	if err != nil || reply != smfirContinue {
+		return reply, data, err
+	}
+
+	for len(body) > 0 {
+		chunk := body
+		if len(chunk) > milterChunk {
+			chunk = chunk[:milterChunk]
+		}
+		body = body[len(chunk):]
+		reply, data, err = mc.command(smficBody, smfipNoBody, smfipNoReplyBody, chunk)
+		if err == nil && reply == smfirSkip {
+			break
+		}
+		if err != nil || reply != smfirContinue {
+			return reply, data, err
+		}
+	}
+	return smfirContinue, nil, nil
+}
+
+// messageEdit collects the changes a milter asks for at end of message.
+type messageEdit struct {
+	edits   []headerEdit
+	body    []byte
+	newBody bool
+}
+
+type headerEdit struct {
+	op    byte
+	index int
+	name  string
+	value string
+}
+
+func (e *messageEdit) add(mc *milterClient, reply byte, data []byte) error {
+	if reply == smfirReplBody {
+		if mc.actions&smfiChgBody == 0 {
+			return nil
+		}
+		e.body = append(e.body, data...)
+		e.newBody = true
+		return nil
+	}
+
+	need := uint32(smfiAddHeaders)
+	if reply == smfirChgHeader {
+		need = smfiChgHeaders
+	}
+	if mc.actions&need == 0 {
+		return nil
+	}
+	h := headerEdit{op: reply}
+	if reply != smfirAddHeader {
+		if len(data) < 4 {
+			return errMilterProtocol
+		}
+		h.index = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	}
+	parts := bytes.SplitN(data, []byte{0}, 3)
+	if len(parts) < 2 {
+		return errMilterProtocol
+	}
+	h.name = string(parts[0])
+	h.value = strings.Replace(string(parts[1]), "\n", "\r\n", -1)
+	h.value = strings.Replace(h.value, "\r\r\n", "\r\n", -1)
+	e.edits = append(e.edits, h)
+	return nil
+}
+
+func (e *messageEdit) apply(msg []byte) []byte {
+	if len(e.edits) == 0 && !e.newBody {
+		return msg
+	}
+
+	fields, body := splitMessage(msg)
+	for _, h := range e.edits {
+		field := h.name + ": " + h.value + "\r\n"
+		switch h.op {
+		case smfirAddHeader:
+			fields = append(fields, field)
+		case smfirInsHeader:
+			n := h.index
+			if n > len(fields) {
+				n = len(fields)
+			}
+			fields = append(fields[:n], append([]string{field}, fields[n:]...)...)
+		case smfirChgHeader:
+			// The index counts the fields of that name, from 1.
+			seen := 0
+			for n, f := range fields {
+				if !strings.EqualFold(fieldName(f), h.name) {
+					continue
+				}
+				if seen++; seen != h.index {
+					continue
+				}
+				if h.value == "" {
+					fields = append(fields[:n], fields[n+1:]...)
+				} else {
+					fields[n] = field
+				}
+				break
+			}
+		}
+	}
+	if e.newBody {
+		body = e.body
+	}
+
+	buf := new(bytes.Buffer)
+	for _, f := range fields {
+		buf.WriteString(f)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Abort ends a message the milters have seen part of.
+func (m *milterChain) Abort() {
+	if m == nil || !m.inMessage {
+		return
+	}
+	m.inMessage = false
+	for _, mc := range m.clients {
+		if !mc.broken {
+			if err := mc.write(smficAbort, nil); err != nil {
+				mc.broken = true
+				mc.conn.Close()
+			}
+		}
+	}
+}
+
+func (m *milterChain) Close() {
+	if m == nil {
+		return
+	}
+	for _, mc := range m.clients {
+		if !mc.broken {
+			mc.close()
+		}
+	}
+}
+
+// ParseMilterAddress accepts the Postfix and Sendmail forms "unix:/path",
+// "inet:host:port" and "inet:port@host", or a plain "host:port".
+func ParseMilterAddress(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, "unix:"), strings.HasPrefix(s, "local:"):
+		return "unix", s[strings.IndexByte(s, ':')+1:], nil
+	case strings.HasPrefix(s, "inet:"), strings.HasPrefix(s, "inet6:"):
+		s = s[strings.IndexByte(s, ':')+1:]
+		if l := strings.IndexByte(s, '@'); l >= 0 {
+			s = net.JoinHostPort(s[l+1:], s[:l])
+		}
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func packet(code byte, data string) []byte {
+	p := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(p, uint32(len(data)+1))
+	p[4] = code
+	return append(p, data...)
+}
+
+func TestMilterRead(t *testing.T) {
+	header := func(n uint32) string {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, n)
+		return string(b)
+	}
+	tests := []struct {
+		name string
+		wire string
+		code byte
+		data string
+		err  error
+	}{
+		{"continue", string(packet(smfirContinue, "")), smfirContinue, "", nil},
+		{"with data", string(packet(smfirReplyCode, "550 no\x00")), smfirReplyCode, "550 no\x00", nil},
+		{"empty frame", header(0), 0, "", errMilterProtocol},
+		{"oversized frame", header(1<<20 + 1), 0, "", errMilterProtocol},
+		{"short frame", header(10) + "abc", 0, "", io.ErrUnexpectedEOF},
+		{"short header", "\x00\x00", 0, "", io.ErrUnexpectedEOF},
+		{"closed", "", 0, "", io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				server.Write([]byte(tt.wire))
+				server.Close()
+			}()
+
+			mc := &milterClient{MilterSetting: MilterSetting{Timeout: time.Second}, conn: client, r: bufio.NewReader(client)}
+			code, data, err := mc.read()
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if code != tt.code || string(data) != tt.data {
+				t.Errorf("read = %q %q, want %q %q", code, data, tt.code, tt.data)
+			}
+		})
+	}
+}
+
+// fakeMilter negotiates every optional step away, so that only the end of
+// message gets a reply, and answers it with eob.
+func fakeMilter(t *testing.T, eob ...[]byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				mc := &milterClient{MilterSetting: MilterSetting{Timeout: 5 * time.Second}, conn: c, r: bufio.NewReader(c)}
+				for {
+					code, _, err := mc.read()
+					if err != nil {
+						return
+					}
+					switch code {
+					case smficOptNeg:
+						data := make([]byte, 12)
+						binary.BigEndian.PutUint32(data, milterVersion)
+						binary.BigEndian.PutUint32(data[4:], milterActions)
+						binary.BigEndian.PutUint32(data[8:], milterProtocol)
+						mc.write(smficOptNeg, data)
+					case smficEOB:
+						for _, p := range eob {
+							c.Write(p)
+						}
+					case smficQuit:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMilterData(t *testing.T) {
+	conf := &Config{ServerName: "mx.example.org"}
+	state := &smtp.ConnectionState{Hostname: "client.example", RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25}}
+	msg := []byte("Subject: hi\r\n\r\nbody\r\n")
+
+	tests := []struct {
+		name       string
+		eob        [][]byte
+		action     PolicyAction
+		code       int
+		want       string
+		quarantine int
+	}{
+		{"continue", [][]byte{packet(smfirContinue, "")}, "", 0, string(msg), 0},
+		{"add header", [][]byte{packet(smfirAddHeader, "X-Scan\x00clean\x00"), packet(smfirAccept, "")}, "", 0, "Subject: hi\r\nX-Scan: clean\r\n\r\nbody\r\n", 0},
+		{"progress then continue", [][]byte{packet(smfirProgress, ""), packet(smfirContinue, "")}, "", 0, string(msg), 0},
+		{"quarantine", [][]byte{packet(smfirQuarantine, "looks bad\x00"), packet(smfirContinue, "")}, "", 0, string(msg), 1},
+		{"reject", [][]byte{packet(smfirReject, "")}, "", 550, "", 0},
+		{"tempfail", [][]byte{packet(smfirTempfail, "")}, "", 451, "", 0},
+		{"reply code", [][]byte{packet(smfirReplyCode, "554 5.7.1 go away\x00")}, "", 554, "", 0},
+		{"bad reply code", [][]byte{packet(smfirReplyCode, "250 ok\x00")}, "", 451, "", 0},
+		{"unexpected reply, accept", [][]byte{packet('?', "")}, ActionAccept, 0, string(msg), 0},
+		{"unexpected reply, tempfail", [][]byte{packet('?', "")}, ActionTempfail, 451, "", 0},
+		{"short header edit", [][]byte{packet(smfirChgHeader, "\x00\x00")}, ActionReject, 550, "", 0},
+		{"oversized frame", [][]byte{{0x10, 0, 0, 0}}, ActionTempfail, 451, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := MilterSetting{Name: "test", Network: "tcp", Address: fakeMilter(t, tt.eob...), Timeout: 2 * time.Second, DefaultAction: tt.action}
+			m, err := openMilters([]MilterSetting{ms}, conf, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if err := m.Mail("a@example.net", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			got, quarantine, err := m.Data(msg)
+			if tt.code != 0 {
+				se, ok := asSMTPError(err)
+				if !ok || se.Code != tt.code {
+					t.Fatalf("err = %v, want %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("message = %q, want %q", got, tt.want)
+			}
+			if len(quarantine) != tt.quarantine {
+				t.Errorf("quarantine = %v", quarantine)
+			}
+		})
+	}
+}
+
+func TestMilterUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	state := &smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}}
+	tests := []struct {
+		action PolicyAction
+		code   int
+	}{
+		{ActionAccept, 0},
+		{ActionTempfail, 451},
+		{"", 451},
+		{ActionReject, 550},
+	}
+	for _, tt := range tests {
+		ms := MilterSetting{Name: "down", Network: "tcp", Address: addr, DefaultAction: tt.action}
+		m, err := openMilters([]MilterSetting{ms}, &Config{}, state)
+		if tt.code == 0 {
+			if err != nil || m == nil {
+				t.Errorf("%s: %v", tt.action, err)
+			}
+			continue
+		}
+		if se, ok := asSMTPError(err); !ok || se.Code != tt.code {
+			t.Errorf("%s: err = %v, want %d", tt.action, err, tt.code)
+		}
+	}
+}
+
+func TestMessageEditApply(t *testing.T) {
+	msg := []byte("Received: a\r\nSubject: hi\r\nReceived: b\r\n\r\nbody\r\n")
+	tests := []struct {
+		name string
+		edit messageEdit
+		want string
+	}{
+		{"none", messageEdit{}, string(msg)},
+		{"insert first", messageEdit{edits: []headerEdit{{op: smfirInsHeader, index: 0, name: "X-A", value: "1"}}},
+			"X-A: 1\r\nReceived: a\r\nSubject: hi\r\nReceived: b\r\n\r\nbody\r\n"},
+		{"insert past the end", messageEdit{edits: []headerEdit{{op: smfirInsHeader, index: 9, name: "X-A", value: "1"}}},
+			"Received: a\r\nSubject: hi\r\nReceived: b\r\nX-A: 1\r\n\r\nbody\r\n"},
+		{"change second", messageEdit{edits: []headerEdit{{op: smfirChgHeader, index: 2, name: "received", value: "c"}}},
+			"Received: a\r\nSubject: hi\r\nreceived: c\r\n\r\nbody\r\n"},
+		{"delete", messageEdit{edits: []headerEdit{{op: smfirChgHeader, index: 1, name: "Subject"}}},
+			"Received: a\r\nReceived: b\r\n\r\nbody\r\n"},
+		{"change missing", messageEdit{edits: []headerEdit{{op: smfirChgHeader, index: 3, name: "Received", value: "c"}}},
+			string(msg)},
+		{"replace body", messageEdit{body: []byte("new\r\n"), newBody: true},
+			"Received: a\r\nSubject: hi\r\nReceived: b\r\n\r\nnew\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.edit.apply(msg)); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMilterAddress(t *testing.T) {
+	tests := []struct {
+		in, network, addr string
+		ok                bool
+	}{
+		{"unix:/run/milter.sock", "unix", "/run/milter.sock", true},
+		{"local:/run/milter.sock", "unix", "/run/milter.sock", true},
+		{"inet:127.0.0.1:8891", "tcp", "127.0.0.1:8891", true},
+		{"inet:8891@localhost", "tcp", "localhost:8891", true},
+		{"inet6:8891@::1", "tcp", "[::1]:8891", true},
+		{"localhost:8891", "tcp", "localhost:8891", true},
+		{"localhost", "", "", false},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseMilterAddress(tt.in)
+		if (err == nil) != tt.ok || network != tt.network || addr != tt.addr {
+			t.Errorf("ParseMilterAddress(%q) = %q, %q, %v", tt.in, network, addr, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimits are the limits for one client address or network, zero means
+// unlimited.
+type RateLimits struct {
+	Connections       int
+	MessagesPerMinute int
+	RecipientsPerHour int
+}
+
+// RateLimitSetting limits anonymous inbound sessions per client address and
+// per client network (/24 or /64). Clients in Whitelist are not limited.
+type RateLimitSetting struct {
+	PerIP      RateLimits
+	PerNetwork RateLimits
+	Whitelist  []*net.IPNet
+}
+
+// bucket is a token bucket holding up to limit tokens, refilled at limit
+// per period.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(limit int, period time.Duration, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(limit) / period.Seconds()
+		if b.tokens > float64(limit) {
+			b.tokens = float64(limit)
+		}
+	}
+	b.last = now
+}
+
+type clientRate struct {
+	conns    int
+	messages bucket
+	rcpts    bucket
+	seen     time.Time
+}
+
+type rateKind int
+
+const (
+	rateMessage rateKind = iota
+	rateRcpt
+)
+
+func (be *Backend) clientRate(key string, now time.Time) *clientRate {
+	if be.rates == nil {
+		be.rates = map[string]*clientRate{}
+	}
+
+	// Forget idle clients once in a while, their buckets are full again.
+	if now.Sub(be.ratesSwept) > time.Minute {
+		for k, cr := range be.rates {
+			if cr.conns == 0 && now.Sub(cr.seen) > time.Hour {
+				delete(be.rates, k)
+			}
+		}
+		be.ratesSwept = now
+	}
+
+	cr, ok := be.rates[key]
+	if !ok {
+		cr = new(clientRate)
+		be.rates[key] = cr
+	}
+	cr.seen = now
+	return cr
+}
+
+func rateKeys(ip net.IP) [2]string {
+	return [2]string{"ip:" + ip.String(), "net:" + networkKey(ip)}
+}
+
+// acquireConn counts a new session of ip, or reports false when the address
+// or its network already has too many.
+func (be *Backend) acquireConn(s RateLimitSetting, ip net.IP) bool {
+	if inNetworks(s.Whitelist, ip) {
+		return true
+	}
+
+	be.rateMu.Lock()
+	defer be.rateMu.Unlock()
+
+	now := time.Now()
+	keys := rateKeys(ip)
+	ipRate, netRate := be.clientRate(keys[0], now), be.clientRate(keys[1], now)
+	if (s.PerIP.Connections > 0 && ipRate.conns >= s.PerIP.Connections) ||
+		(s.PerNetwork.Connections > 0 && netRate.conns >= s.PerNetwork.Connections) {
+		return false
+	}
+	ipRate.conns++
+	netRate.conns++
+	return true
+}
+
+func (be *Backend) releaseConn(s RateLimitSetting, ip net.IP) {
+	if inNetworks(s.Whitelist, ip) {
+		return
+	}
+
+	be.rateMu.Lock()
+	defer be.rateMu.Unlock()
+
+	now := time.Now()
+	for _, key := range rateKeys(ip) {
+		if cr := be.clientRate(key, now); cr.conns > 0 {
+			cr.conns--
+		}
+	}
+}
+
+// LimitListener counts the connections of ln per client address and network
+// as they are accepted, since go-smtp only creates the session at the first
+// MAIL. A client over its limit is answered with a 421 and closed.
+func (be *Backend) LimitListener(ln net.Listener) net.Listener {
+	return &limitListener{Listener: ln, be: be}
+}
+
+type limitListener struct {
+	net.Listener
+	be *Backend
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, err := ParseAddr(c.RemoteAddr())
+		if err != nil {
+			return c, nil
+		}
+
+		s := l.be.CurrentConfig().RateLimit
+		if !l.be.acquireConn(s, ip) {
+			log.Println("[ratelimit] too many connections from", ip)
+			// A client that doesn't read mustn't hold up the others.
+			go tooManyConnections(c)
+			continue
+		}
+		return &limitedConn{Conn: c, release: func() { l.be.releaseConn(s, ip) }}, nil
+	}
+}
+
+func tooManyConnections(c net.Conn) {
+	se, _ := asSMTPError(NewTooManyConnectionsError())
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c, "%d %d.%d.%d %s\r\n", se.Code, se.EnhancedCode[0], se.EnhancedCode[1], se.EnhancedCode[2], se.Message)
+	c.Close()
+}
+
+// limitedConn gives its slot back on the first Close.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// allow takes a token for a message or a recipient from both the address
+// and the network bucket, or none if either is empty.
+func (be *Backend) allow(s RateLimitSetting, ip net.IP, kind rateKind) bool {
+	if inNetworks(s.Whitelist, ip) {
+		return true
+	}
+
+	be.rateMu.Lock()
+	defer be.rateMu.Unlock()
+
+	now := time.Now()
+	keys := rateKeys(ip)
+	limits := [2]RateLimits{s.PerIP, s.PerNetwork}
+
+	var buckets [2]*bucket
+	for n, key := range keys {
+		cr := be.clientRate(key, now)
+		limit, period := limits[n].MessagesPerMinute, time.Minute
+		buckets[n] = &cr.messages
+		if kind == rateRcpt {
+			limit, period = limits[n].RecipientsPerHour, time.Hour
+			buckets[n] = &cr.rcpts
+		}
+		if limit <= 0 {
+			buckets[n] = nil
+			continue
+		}
+		buckets[n].refill(limit, period, now)
+		if buckets[n].tokens < 1 {
+			return false
+		}
+	}
+
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
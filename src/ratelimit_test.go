@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &Backend{Config: &Config{RateLimit: RateLimitSetting{PerIP: RateLimits{Connections: 2}}}}
+	ll := be.LimitListener(ln)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// refused reads what the listener wrote to c, if anything, before it
+	// closed the connection.
+	refused := func(c net.Conn) string {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		return line
+	}
+
+	c1, c2 := dial(), dial()
+	s1, s2 := <-accepted, <-accepted
+
+	c3 := dial()
+	if line := refused(c3); !strings.HasPrefix(line, "421 4.7.0 ") {
+		t.Errorf("third connection got %q, want a 421", line)
+	}
+	c3.Close()
+
+	// Closing a server side connection frees its slot, once.
+	s1.Close()
+	s1.Close()
+	c4 := dial()
+	s4 := <-accepted
+	if line := refused(c4); line != "" {
+		t.Errorf("fourth connection got %q", line)
+	}
+
+	c5 := dial()
+	if line := refused(c5); !strings.HasPrefix(line, "421 ") {
+		t.Errorf("fifth connection got %q, want a 421", line)
+	}
+	for _, c := range []net.Conn{c1, c2, c4, c5, s2, s4} {
+		c.Close()
+	}
+}
+
+// pipeListener hands out the server ends of pipes, which block writes until
+// the client reads.
+type pipeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) { return <-l.conns, nil }
+
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestLimitListenerSlowClient(t *testing.T) {
+	pl := &pipeListener{conns: make(chan net.Conn, 3)}
+	be := &Backend{Config: &Config{RateLimit: RateLimitSetting{PerIP: RateLimits{Connections: 1}}}}
+	ll := be.LimitListener(pl)
+
+	var clients []net.Conn
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 1)} {
+		client, server := net.Pipe()
+		clients = append(clients, client)
+		pl.conns <- &pipeConn{Conn: server, remote: &net.TCPAddr{IP: ip}}
+	}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	if _, err := ll.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	// The second client doesn't read its 421, the third is accepted anyway.
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := ll.Accept()
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		if c.RemoteAddr().String() != "198.51.100.1:0" {
+			t.Errorf("accepted %s", c.RemoteAddr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept blocked on a client not reading")
+	}
+
+	line, _ := bufio.NewReader(clients[1]).ReadString('\n')
+	if !strings.HasPrefix(line, "421 ") {
+		t.Errorf("refused client got %q, want a 421", line)
+	}
+}
+
+func TestAllowMessages(t *testing.T) {
+	be := &Backend{}
+	s := RateLimitSetting{
+		PerIP:      RateLimits{MessagesPerMinute: 2},
+		PerNetwork: RateLimits{MessagesPerMinute: 3},
+		Whitelist:  []*net.IPNet{{IP: net.IPv4(192, 0, 2, 128), Mask: net.CIDRMask(25, 32)}},
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		// The /24 is out of tokens now.
+		{"192.0.2.3", false},
+		{"192.0.2.200", true},
+		{"198.51.100.1", true},
+	}
+	for i, tt := range tests {
+		if got := be.allow(s, net.ParseIP(tt.ip), rateMessage); got != tt.want {
+			t.Errorf("%d: allow(%s) = %v, want %v", i, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -3,11 +3,11 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	n_smtp "net/smtp"
 	"strings"
 
 	"github.com/emersion/go-msgauth/dkim"
@@ -17,15 +17,21 @@ import (
 )
 
 type sender2 struct {
+	user string
 	from string
-	to   string
+	to   []string
+	utf8 bool
 	st   *smtp.ConnectionState
-	ctx  context.Context
+	// milter runs the milters of the listener over the whole session.
+	milter *milterChain
+	ctx    context.Context
 }
 
 func (s *sender2) Reset() {
 	s.from = ""
-	s.to = ""
+	s.to = nil
+	s.utf8 = false
+	s.milter.Abort()
 }
 
 func (s *sender2) Mail(from string, opts smtp.MailOptions) error {
@@ -36,7 +42,33 @@ func (s *sender2) Mail(from string, opts smtp.MailOptions) error {
 			Message:      "Error: nested MAIL command",
 		}
 	}
+
+	if !opts.UTF8 && !isASCII(from) {
+		log.Printf("553 %s(%s) %s: SMTPUTF8 required\r\n", s.st.Hostname, s.st.RemoteAddr, from)
+		return NewUTF8RequiredError(from)
+	}
+	addr, err := NormalizeAddress(from)
+	if err != nil {
+		log.Printf("501 %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, from, err)
+		return NewBadSenderError(from)
+	}
+	from = addr
+
+	conf := GetConfig(s.ctx)
+	if !SenderAllowed(conf.AllowedSenders(s.user), from) {
+		log.Printf("553 %s(%s) %s: %s not allowed\r\n", s.st.Hostname, s.st.RemoteAddr, s.user, from)
+		return NewSenderNotOwnedError(from)
+	}
+	if limit := s.sizeLimit(conf); limit > 0 && opts.Size > limit {
+		log.Printf("552 %s(%s) %s: SIZE=%d\r\n", s.st.Hostname, s.st.RemoteAddr, s.user, opts.Size)
+		return NewMessageTooLargeError()
+	}
+	if err := s.milter.Mail(from, s.user); err != nil {
+		log.Printf("%s %s(%s) %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, from)
+		return err
+	}
 	s.from = from
+	s.utf8 = opts.UTF8
 
 	log.Println("MAIL FROM:", from)
 	return nil
@@ -50,28 +82,55 @@ func (s *sender2) Rcpt(to string) error {
 			Message:      "Error: need MAIL command",
 		}
 	}
-	s.to = to
 
 	conf := GetConfig(s.ctx)
 
-	if !AllowedTo(conf.Allocation, s.from) {
+	if !AllowedSender(conf.Allocation, s.from) {
 		return NewNotMemberError(s.from)
 	}
 
+	to, err := rcptAddress(to)
+	if err != nil {
+		return NewBadParameterError(err)
+	}
+	if _, host := StripEmail(to); host == "" {
+		return NewBadRecipientError(to)
+	}
+	if !s.utf8 && !isASCII(to) {
+		return NewUTF8RequiredError(to)
+	}
+	addr, err := NormalizeAddress(to)
+	if err != nil {
+		return NewBadRecipientError(to)
+	}
+	to = addr
+
+	if err := s.milter.Rcpt(to); err != nil {
+		log.Printf("%s %s(%s) %s -> %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, to)
+		return err
+	}
+
 	log.Println("RCPT TO:", to)
+	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *sender2) Data(data io.Reader) error {
-	if s.from == "" && s.to == "" {
+	if s.from == "" || len(s.to) == 0 {
 		return NewBadCommandError()
 	}
 
 	from := ""
 
-	m := NewMail(data)
+	buf, err := ioutil.ReadAll(newLimitReader(data, s.sizeLimit(GetConfig(s.ctx))))
+	if err != nil {
+		log.Printf("%s %s(%s) %s\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.user)
+		return err
+	}
+
+	m := NewMail(bytes.NewReader(buf))
 	m.init()
-	err := m.Check()
+	err = m.Check()
 	if err != nil {
 		return &smtp.SMTPError{
 			Code:         503,
@@ -86,6 +145,12 @@ func (s *sender2) Data(data io.Reader) error {
 	f, _ := m.Headers.Get("From")
 	fr := ParseAddress(f.Value)
 
+	conf := GetConfig(s.ctx)
+	if !SenderAllowed(conf.AllowedSenders(s.user), fr) {
+		log.Printf("553 %s(%s) %s: header From %s not allowed\r\n", s.st.Hostname, s.st.RemoteAddr, s.user, fr)
+		return NewSenderNotOwnedError(fr)
+	}
+
 	if fro, ok := store.Current().Get(to); ok {
 		from = fro
 	} else {
@@ -95,7 +160,6 @@ func (s *sender2) Data(data io.Reader) error {
 		store.Current().Set(to, from)
 	}
 
-	conf := GetConfig(s.ctx)
 	if from != "" {
 		m.Headers.Replace("From", conf.FromName+" <"+from+">")
 	}
@@ -130,7 +194,7 @@ func (s *sender2) Data(data io.Reader) error {
 			StripPort(s.st.RemoteAddr),
 			StripPort(s.st.LocalAddr),
 			conf.Name,
-			s.to,
+			s.to[0],
 			t,
 			now(),
 		),
@@ -144,30 +208,91 @@ func (s *sender2) Data(data io.Reader) error {
 		Signer:   privateKey,
 	}
 
+	msg, _ := ioutil.ReadAll(m.Reader())
+	msg, quarantine, err := s.milter.Data(msg)
+	if err != nil {
+		log.Printf("%s %s(%s) %s -> %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return err
+	}
+	if s.milter.Discarded() {
+		log.Printf("[milter] %s(%s) %s -> %s: discarded\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return nil
+	}
+
+	var virus string
+	if msg, virus, err = conf.Virus.check(conf, msg); err != nil {
+		log.Printf("%s %s(%s) %s -> %s: clamd\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return err
+	}
+	if virus != "" {
+		log.Printf("[clamd] %s(%s) %s: %s, %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, virus, conf.Virus.Action)
+		if conf.Virus.Action == ActionQuarantine {
+			quarantine = append(quarantine, "virus "+virus)
+		}
+	}
+
+	rcpts := s.to
+	if len(quarantine) > 0 {
+		q := new(bytes.Buffer)
+		for _, r := range quarantine {
+			fmt.Fprintf(q, "X-Quarantine: %s\r\n", r)
+		}
+		msg = append(q.Bytes(), msg...)
+		if conf.QuarantineTo != "" {
+			rcpts = []string{conf.QuarantineTo}
+		}
+	}
+
 	var b bytes.Buffer
-	if err := dkim.Sign(&b, m.Reader(), options); err != nil {
+	if err := dkim.Sign(&b, bytes.NewReader(msg), options); err != nil {
 		log.Fatal(err)
 	}
 
 	z, _ := ioutil.ReadAll(&b)
 
-	_, domain := StripEmail(s.to)
-	hosts, err := GetMXHosts(domain)
-	if err != nil {
-		return NewNotFoundError(s.to)
+	var domains []string
+	byDomain := map[string][]string{}
+	for _, to := range rcpts {
+		_, domain := StripEmail(to)
+		domain = strings.ToLower(domain)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], to)
 	}
 
-	for _, host := range hosts {
-		err = n_smtp.SendMail(host+":smtp", nil, from, []string{s.to}, z)
-		if err == nil {
-			log.Printf("200 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, s.to)
-			return nil
+	var failed []string
+	var reports []DSNRecipient
+	for _, domain := range domains {
+		rcpts := byDomain[domain]
+		if err = deliverMX(domain, from, rcpts, z, s.utf8); err != nil {
+			log.Printf("%s %s(%s) %s -> %s\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(rcpts, ","))
+			failed = append(failed, rcpts...)
+			reports = append(reports, dsnRecipients(rcpts, "failed", failedStatus(err), diagnostic(err))...)
+			continue
 		}
+		log.Printf("200 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(rcpts, ","))
 	}
 
-	return NewError(err)
+	if len(failed) == len(rcpts) {
+		if len(domains) == 1 {
+			return err
+		}
+		return NewError(errors.New("delivery failed for all recipients"))
+	}
+	if len(failed) > 0 {
+		log.Printf("[send] partial delivery, failed: %s\r\n", strings.Join(failed, ","))
+		go sendDSN(conf, s.from, reports, z)
+	}
+	return nil
+}
+
+// sizeLimit is the listener's limit, lowered by the user's own.
+func (s *sender2) sizeLimit(conf *Config) int {
+	return sizeLimit(listenerLimit(s.ctx), conf.MaxMessageBytes(s.user))
 }
 
 func (s *sender2) Logout() error {
+	s.milter.Close()
 	return nil
 }
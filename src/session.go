@@ -47,6 +47,10 @@ func (s *session) Mail(from string, opts smtp.MailOptions) error {
 			Message:      "Error: nested MAIL command",
 		}
 	}
+	if limit := listenerLimit(s.ctx); limit > 0 && opts.Size > limit {
+		log.Printf("552 %s(%s) %s: SIZE=%d\r\n", s.st.Hostname, s.st.RemoteAddr, from, opts.Size)
+		return NewMessageTooLargeError()
+	}
 	log.Println("MAIL FROM:", from)
 	s.from = from
 	s.opts = &opts
@@ -81,30 +85,8 @@ func (s *session) Data(r io.Reader) error {
 		}
 	}
 
-	conn, err := s.be.newConn()
-	if err != nil {
-		return err
-	}
-	defer conn.Quit()
-
 	conf := GetConfig(s.ctx)
 
-	s.opts.Size = 0
-	err = conn.Mail(conf.ProxyEnvelope, s.opts)
-	if err != nil {
-		return err
-	}
-
-	err = conn.Rcpt(conf.ProxyAddress)
-	if err != nil {
-		return errors.New("Server Error")
-	}
-
-	wc, err := conn.Data()
-	if err != nil {
-		return err
-	}
-
 	t := ""
 	if s.st.TLS.Version != 0 {
 		t = "(version="
@@ -124,15 +106,16 @@ func (s *session) Data(r io.Reader) error {
 		t = ";"
 	}
 
-	fmt.Fprintf(wc, "X-Transfer-To: %s\r\n", conf.ProxyAddress)
-	fmt.Fprintf(wc, "Deliverd-To: %s\r\n", s.to)
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "X-Transfer-To: %s\r\n", conf.ProxyAddress)
+	fmt.Fprintf(msg, "Deliverd-To: %s\r\n", s.to)
 
-	z := SpfHeader(s.st.RemoteAddr, s.from)
+	z := SpfHeader(conf.ServerName, s.st.RemoteAddr, s.from, s.st.Hostname)
 	if z != "" {
-		fmt.Fprintf(wc, z)
+		fmt.Fprintf(msg, z)
 	}
 
-	fmt.Fprintf(wc, "Received: from %s (%s %s)\r\n"+
+	fmt.Fprintf(msg, "Received: from %s (%s %s)\r\n"+
 		"       by %s (%s %s)\r\n"+
 		"       for <%s>"+
 		"\r\n       %s%s \r\n",
@@ -147,12 +130,16 @@ func (s *session) Data(r io.Reader) error {
 		now(),
 	)
 
-	reader := bufio.NewReader(r)
+	reader := bufio.NewReader(newLimitReader(r, listenerLimit(s.ctx)))
 	for {
 		line, _, err := reader.ReadLine()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			log.Println("data Reading error:", err)
+			return err
+		}
 		if strings.Index(strings.ToLower(string(line)), "message-id") == 0 {
 			log.Println(line)
 			log.Println(string(line))
@@ -165,19 +152,49 @@ func (s *session) Data(r io.Reader) error {
 				enc.Write([]byte(s.to))
 				enc.Close()
 
-				fmt.Fprintf(wc, "Message-ID: <fujinami+%s+%s>\r\n", re.String(), id)
+				fmt.Fprintf(msg, "Message-ID: <fujinami+%s+%s>\r\n", re.String(), id)
 				continue
 			}
 		}
-		wc.Write(line)
-		wc.Write([]byte("\r\n"))
+		msg.Write(line)
+		msg.Write([]byte("\r\n"))
 
 		if len(line) == 0 {
 			break
 		}
 	}
 
-	_, err = io.Copy(wc, reader)
+	if _, err := io.Copy(msg, reader); err != nil {
+		log.Println("data Reading error:", err)
+		return err
+	}
+
+	conn, err := s.be.newConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	// The upstream gets the size of the message as it is sent, not the
+	// one the client declared.
+	opts := *s.opts
+	opts.Size = msg.Len()
+	err = conn.Mail(conf.ProxyEnvelope, &opts)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Rcpt(conf.ProxyAddress)
+	if err != nil {
+		return errors.New("Server Error")
+	}
+
+	wc, err := conn.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = wc.Write(msg.Bytes())
 	if err != nil {
 		log.Println("data writing error:", err)
 
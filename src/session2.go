@@ -2,28 +2,57 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
 	"github.com/emersion/go-smtp"
 	"github.com/mileusna/spf"
 
 	"gosmtp/src/store"
 )
 
+// srsReturn is a bounce received at one of our SRS addresses, to be sent
+// back to the sender the address was made from.
+type srsReturn struct {
+	rcpt string
+	orig string
+}
+
 type session2 struct {
 	c         *smtp.Client
 	be        *Backend
 	st        *smtp.ConnectionState
 	opts      *smtp.MailOptions
+	mail      bool
 	from      string
-	to        string
+	to        []string
+	returns   []srsReturn
 	spfResult spf.Result
-	ctx       context.Context
+	spfHelo   spf.Result
+	// spfHeloName is the name spfHelo was checked for, it is kept over
+	// the transactions of the session.
+	spfHeloName string
+	// spfByHelo is set when spfAction comes from the HELO result.
+	spfByHelo bool
+	spfAction PolicyAction
+	// greylisted is set once a recipient went through greylisting.
+	greylisted bool
+	iprev      authres.ResultValue
+	arc        ARCResult
+	dkim       []DKIMResult
+	dmarc      *DMARCResult
+	tags       []string
+	// quarantine holds the reasons the message is quarantined for.
+	quarantine []string
+	ctx        context.Context
+	milter     *milterChain
 }
 
 func (s *session2) successlog() {
@@ -31,17 +60,25 @@ func (s *session2) successlog() {
 		recover()
 	}()
 
-	log.Printf("200 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, s.to)
+	log.Printf("200 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
 }
 
 func (s *session2) Reset() {
+	s.mail = false
 	s.from = ""
-	s.to = ""
+	s.to = nil
+	s.returns = nil
 	s.opts = nil
+	s.greylisted = false
+	s.dkim = nil
+	s.dmarc = nil
+	s.tags = nil
+	s.quarantine = nil
+	s.milter.Abort()
 }
 
 func (s *session2) Mail(from string, opts smtp.MailOptions) error {
-	if s.from != "" {
+	if s.mail {
 		return &smtp.SMTPError{
 			Code:         503,
 			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
@@ -49,8 +86,10 @@ func (s *session2) Mail(from string, opts smtp.MailOptions) error {
 		}
 	}
 
-	if from == "" {
-		log.Printf("501 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, s.to)
+	// The null sender of bounces is only accepted with SRS, which makes
+	// them come back to us.
+	if from == "" && !GetConfig(s.ctx).SRS.Enabled() {
+		log.Printf("501 %s(%s) %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from)
 		return &smtp.SMTPError{
 			Code:         501,
 			EnhancedCode: smtp.EnhancedCode{5, 0, 1},
@@ -59,17 +98,75 @@ func (s *session2) Mail(from string, opts smtp.MailOptions) error {
 		}
 	}
 	log.Println("MAIL FROM:", from)
-	s.from = from
-	s.opts = &opts
 
+	if !opts.UTF8 && !isASCII(from) {
+		log.Printf("553 %s(%s) %s: SMTPUTF8 required\r\n", s.st.Hostname, s.st.RemoteAddr, from)
+		return NewUTF8RequiredError(from)
+	}
+	addr, err := NormalizeAddress(from)
+	if err != nil {
+		log.Printf("501 %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, from, err)
+		return NewBadSenderError(from)
+	}
+	from = addr
+
+	conf := GetConfig(s.ctx)
 	ip, _ := ParseAddr(s.st.RemoteAddr)
-	s.spfResult = spf.CheckHost(ip, s.st.Hostname, from, s.st.Hostname)
+	if limit := listenerLimit(s.ctx); limit > 0 && opts.Size > limit {
+		log.Printf("552 %s(%s) %s: SIZE=%d\r\n", s.st.Hostname, s.st.RemoteAddr, from, opts.Size)
+		return NewMessageTooLargeError()
+	}
+
+	if err := s.milter.Mail(from, ""); err != nil {
+		log.Printf("%s %s(%s) %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, from)
+		return err
+	}
+
+	s.mail = true
+	s.from = from
+	s.opts = &opts
+	if s.spfHeloName != s.st.Hostname {
+		s.spfHelo = CheckSPFHelo(ip, s.st.Hostname)
+		s.spfHeloName = s.st.Hostname
+	}
+	s.spfResult = s.spfHelo
+	if from != "" {
+		s.spfResult = CheckSPF(ip, from, s.st.Hostname)
+	}
+	// The policy applies to the HELO identity for the null sender, and to
+	// a HELO name failing SPF whatever the sender, as policyd-spf does.
+	s.spfByHelo = from == "" || s.spfHelo == spf.Fail
+	domain, result := s.spfPolicy()
+	s.spfAction = conf.SPF.Action(result)
+	if s.spfAction != ActionAccept {
+		log.Printf("[spf] %s(%s) %s: %s %s, %s\r\n", s.st.Hostname, s.st.RemoteAddr, from, domain, result, s.spfAction)
+	}
+	if s.spfAction == ActionTag {
+		s.tags = append(s.tags, fmt.Sprintf("X-SPF-Policy: %s (%s)", strings.ToLower(result.String()), domain))
+	}
 
 	return nil
 }
 
+// spfDomain is the identity the MAIL FROM result is for.
+func (s *session2) spfDomain() string {
+	if _, domain := StripEmail(s.from); domain != "" {
+		return domain
+	}
+	return s.st.Hostname
+}
+
+// spfPolicy returns the identity the SPF policy was applied to and its
+// result.
+func (s *session2) spfPolicy() (string, spf.Result) {
+	if s.spfByHelo {
+		return s.st.Hostname, s.spfHelo
+	}
+	return s.spfDomain(), s.spfResult
+}
+
 func (s *session2) Rcpt(to string) error {
-	if s.from == "" {
+	if !s.mail {
 		return &smtp.SMTPError{
 			Code:         503,
 			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
@@ -78,17 +175,101 @@ func (s *session2) Rcpt(to string) error {
 	}
 
 	log.Println("RCPT TO:", to)
-	s.to = to
 
-	if err := Allocate(s.ctx, s.from, s.to); err != nil {
-		log.Printf("553 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, s.to)
+	to, err := rcptAddress(to)
+	if err != nil {
+		log.Printf("555 %s(%s) %s -> %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to, err)
+		return NewBadParameterError(err)
+	}
+	if !s.opts.UTF8 && !isASCII(to) {
+		log.Printf("553 %s(%s) %s -> %s: SMTPUTF8 required\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to)
+		return NewUTF8RequiredError(to)
+	}
+	addr, err := NormalizeAddress(to)
+	if err != nil {
+		log.Printf("501 %s(%s) %s -> %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to, err)
+		return NewBadRecipientError(to)
+	}
+	to = addr
+
+	switch domain, result := s.spfPolicy(); s.spfAction {
+	case ActionReject:
+		log.Printf("550 %s(%s) %s -> %s: spf %s %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to, domain, result)
+		return NewSPFFailError(domain, strings.ToLower(result.String()))
+	case ActionTempfail:
+		log.Printf("451 %s(%s) %s -> %s: spf %s %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to, domain, result)
+		return NewSPFTempError(domain, strings.ToLower(result.String()))
+	}
+
+	conf := GetConfig(s.ctx)
+	if ip, err := ParseAddr(s.st.RemoteAddr); err == nil && !s.be.allow(conf.RateLimit, ip, rateRcpt) {
+		log.Printf("451 %s(%s) %s -> %s: recipient rate limit\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to)
+		return NewRcptRateError()
+	}
+
+	if _, host := StripEmail(to); conf.SRS.Enabled() && IsSRS(to) && strings.EqualFold(host, conf.SRS.Domain) {
+		orig, err := conf.SRS.Reverse(to)
+		if err != nil {
+			log.Printf("550 %s(%s) %s -> %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to, err)
+			return NewInvalidSRSError(to)
+		}
+		if err := allocateFrom(conf.Allocation, s.from, to); err != nil {
+			log.Printf("553 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to)
+			return err
+		}
+		if err := s.greylist(conf, to); err != nil {
+			return err
+		}
+		if err := s.milter.Rcpt(to); err != nil {
+			log.Printf("%s %s(%s) %s -> %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, to)
+			return err
+		}
+		s.returns = append(s.returns, srsReturn{rcpt: to, orig: orig})
+		return nil
+	}
+
+	if err := Allocate(s.ctx, s.from, to); err != nil {
+		log.Printf("553 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to)
+		return err
+	}
+	if err := s.greylist(conf, to); err != nil {
 		return err
 	}
+	if err := s.milter.Rcpt(to); err != nil {
+		log.Printf("%s %s(%s) %s -> %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, to)
+		return err
+	}
+	s.to = append(s.to, to)
 	return nil
 }
 
+// greylist defers the first attempt of an unknown client, sender and
+// recipient triplet.
+func (s *session2) greylist(conf *Config, to string) error {
+	g := conf.Greylist
+	if !g.Enabled {
+		return nil
+	}
+	ip, err := ParseAddr(s.st.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	if g.exempt(ip, s.from, s.spfResult, now) {
+		return nil
+	}
+	s.greylisted = true
+	if g.pass(ip, s.from, to, now) {
+		return nil
+	}
+
+	log.Printf("451 %s(%s) %s -> %s: greylisted\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, to)
+	return NewGreylistedError()
+}
+
 func (s *session2) Data(r io.Reader) error {
-	if s.to == "" {
+	if len(s.to) == 0 && len(s.returns) == 0 {
 		return &smtp.SMTPError{
 			Code:         503,
 			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
@@ -96,9 +277,15 @@ func (s *session2) Data(r io.Reader) error {
 		}
 	}
 
+	conf := GetConfig(s.ctx)
+	if ip, err := ParseAddr(s.st.RemoteAddr); err == nil && !s.be.allow(conf.RateLimit, ip, rateMessage) {
+		log.Printf("451 %s(%s) %s -> %s: message rate limit\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return NewMessageRateError()
+	}
+
 	black, blcnt := DnsblChkWithContext(s.ctx, StripPort(s.st.RemoteAddr))
 	if black {
-		log.Printf("503 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, s.to)
+		log.Printf("503 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
 		return &smtp.SMTPError{
 			Code:         550,
 			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
@@ -107,29 +294,371 @@ func (s *session2) Data(r io.Reader) error {
 		}
 	}
 
-	conn, err := s.be.newConn()
+	body, err := s.readBody(newLimitReader(r, listenerLimit(s.ctx)))
 	if err != nil {
+		log.Println("data Reading error:", err)
 		return err
 	}
-	defer conn.Quit()
 
-	conf := GetConfig(s.ctx)
+	if stripped, n := StripAuthResults(body, conf.ServerName); n > 0 {
+		log.Printf("[authres] %s(%s) %s: removed %d forged Authentication-Results\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, n)
+		body = stripped
+	}
 
-	s.opts.Size = 0
-	err = conn.Mail(conf.ProxyEnvelope, s.opts)
-	if err != nil {
+	if s.iprev == "" {
+		if ip, err := ParseAddr(s.st.RemoteAddr); err == nil {
+			s.iprev, _ = CheckIPRev(ip)
+		}
+	}
+
+	var arcErr error
+	if s.arc, arcErr = VerifyARC(body); arcErr != nil {
+		log.Printf("[arc] %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, arcErr)
+	}
+
+	var dkimErr error
+	if s.dkim, dkimErr = VerifyDKIM(body); dkimErr != nil {
+		log.Printf("[dkim] %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, dkimErr)
+	}
+	for _, r := range s.dkim {
+		log.Printf("[dkim] %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, r)
+	}
+	if err := s.checkDKIMPolicy(conf, body); err != nil {
+		return err
+	}
+	if conf.DMARC.Enabled {
+		if err := s.checkDMARC(conf, body); err != nil {
+			return err
+		}
+	}
+
+	var quarantine []string
+	if body, quarantine, err = s.milter.Data(body); err != nil {
+		log.Printf("%s %s(%s) %s -> %s: milter\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return err
+	}
+	if s.milter.Discarded() {
+		log.Printf("[milter] %s(%s) %s -> %s: discarded\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return nil
+	}
+	s.quarantine = append(s.quarantine, quarantine...)
+
+	var virus string
+	if body, virus, err = conf.Virus.check(conf, body); err != nil {
+		log.Printf("%s %s(%s) %s -> %s: clamd\r\n", err, s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","))
+		return err
+	}
+	if virus != "" {
+		log.Printf("[clamd] %s(%s) %s: %s, %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, virus, conf.Virus.Action)
+		if conf.Virus.Action == ActionQuarantine {
+			s.quarantine = append(s.quarantine, "virus "+virus)
+		}
+	}
+
+	if body, err = s.checkSpam(conf, body); err != nil {
+		return err
+	}
+
+	delivered := 0
+	var failed []DSNRecipient
+	for _, g := range s.groups(conf) {
+		if err = s.forward(conf, g, blcnt, body); err != nil {
+			log.Printf("451 %s(%s) %s -> %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(g.rcpts, ","), err)
+			failed = append(failed, dsnRecipients(g.rcpts, "failed", failedStatus(err), diagnostic(err))...)
+			continue
+		}
+		delivered++
+	}
+	for _, ret := range s.returns {
+		if err = s.returnBounce(conf, ret, blcnt, body); err != nil {
+			log.Printf("451 %s(%s) %s -> %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, ret.rcpt, ret.orig, err)
+			continue
+		}
+		log.Printf("200 %s(%s) %s -> %s\r\n", s.st.Hostname, s.st.RemoteAddr, ret.rcpt, ret.orig)
+		delivered++
+	}
+	if delivered == 0 {
 		return err
 	}
+	// Once the message is accepted, failed groups can only be reported.
+	go sendDSN(conf, s.from, failed, body)
 
-	err = conn.Rcpt(conf.ProxyAddress)
+	if s.greylisted {
+		if ip, err := ParseAddr(s.st.RemoteAddr); err == nil {
+			store.AddGreylistPass(networkKey(ip), time.Now(), conf.Greylist.Lifetime)
+		}
+	}
+
+	s.successlog()
+	return nil
+}
+
+// checkDKIMPolicy applies DKIMVerify to mail from a must-sign domain that
+// has no passing signature of that domain.
+func (s *session2) checkDKIMPolicy(conf *Config, body []byte) error {
+	_, domain := StripEmail(headerFrom(body))
+	listed, ok := conf.DKIMVerify.mustSign(domain)
+	if !ok || dkimSigned(s.dkim, listed) {
+		return nil
+	}
+
+	switch conf.DKIMVerify.Policy {
+	case ActionReject:
+		log.Printf("550 %s(%s) %s: no valid DKIM signature of %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, listed)
+		return NewDKIMRequiredError(listed)
+	case ActionAccept:
+		log.Printf("[dkim] %s(%s) %s: no valid DKIM signature of %s, accepted\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, listed)
+	default:
+		s.tags = append(s.tags, fmt.Sprintf("X-DKIM-Policy: fail (%s must sign)", listed))
+	}
+	return nil
+}
+
+func (s *session2) checkDMARC(conf *Config, body []byte) error {
+	_, domain := StripEmail(headerFrom(body))
+	r := EvaluateDMARC(domain, s.spfResult, s.spfDomain(), s.dkim)
+	s.dmarc = &r
+	log.Printf("[dmarc] %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, r)
+	if r.Result != "fail" {
+		return nil
+	}
+
+	switch r.Policy {
+	case dmarc.PolicyReject:
+		log.Printf("550 %s(%s) %s: rejected by DMARC policy of %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, r.Domain)
+		return NewDMARCRejectError(r.Domain)
+	case dmarc.PolicyQuarantine:
+		s.quarantine = append(s.quarantine, "DMARC policy of "+r.Domain)
+	}
+	return nil
+}
+
+// checkSpam scores the message with the configured scanner, tags it and
+// applies the thresholds of conf.Spam.
+func (s *session2) checkSpam(conf *Config, body []byte) ([]byte, error) {
+	sp := conf.Spam
+	if sp.Scanner == nil {
+		return body, nil
+	}
+	body = stripFields(body, spamHeaders...)
+
+	r, err := sp.Scanner.Scan(body, &ScanEnvelope{
+		From:  s.from,
+		Rcpts: s.to,
+		IP:    StripPort(s.st.RemoteAddr),
+		Helo:  s.st.Hostname,
+	})
 	if err != nil {
-		return errors.New("Server Error")
+		log.Printf("[spam] %s(%s) %s: %s, %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, err, sp.DefaultAction)
+		if sp.DefaultAction == ActionTempfail {
+			return nil, NewScanTempError()
+		}
+		return body, nil
+	}
+	log.Printf("[spam] %s(%s) %s: %s\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, r)
+
+	if sp.Reject > 0 && r.Score >= sp.Reject {
+		log.Printf("550 %s(%s) %s -> %s: spam score %.1f\r\n", s.st.Hostname, s.st.RemoteAddr, s.from, strings.Join(s.to, ","), r.Score)
+		return nil, NewSpamRejectError()
+	}
+	s.tags = append(s.tags, sp.headers(r)...)
+	if sp.Quarantine > 0 && r.Score >= sp.Quarantine {
+		s.quarantine = append(s.quarantine, fmt.Sprintf("spam score %.1f", r.Score))
+	}
+	if sp.Subject > 0 && r.Score >= sp.Subject {
+		body = rewriteSubject(body, sp.SubjectTag)
 	}
+	return body, nil
+}
+
+// forwardGroup collects the recipients that go to the same upstream with the
+// same envelope sender, so each upstream sees the message once.
+type forwardGroup struct {
+	upstream string
+	envelope string
+	rcpts    []string
+	dests    []string
+}
+
+func (s *session2) groups(conf *Config) []*forwardGroup {
+	var groups []*forwardGroup
+	byKey := map[string]*forwardGroup{}
 
-	wc, err := conn.Data()
+	for _, to := range s.to {
+		route, _ := conf.Allocation.Route(to)
+
+		g := &forwardGroup{upstream: route.Upstream, envelope: route.Envelope}
+		if g.envelope == "" {
+			g.envelope = s.envelope(conf)
+		}
+		key := g.upstream + "\x00" + g.envelope
+		if old, ok := byKey[key]; ok {
+			g = old
+		} else {
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+
+		g.rcpts = append(g.rcpts, to)
+
+		dests := route.Destinations
+		if len(dests) == 0 {
+			dests = []string{conf.ProxyAddress}
+		}
+		if len(s.quarantine) > 0 && conf.QuarantineTo != "" {
+			dests = []string{conf.QuarantineTo}
+		}
+		for _, d := range dests {
+			if !contains(g.dests, d) {
+				g.dests = append(g.dests, d)
+			}
+		}
+	}
+	return groups
+}
+
+// envelope is the sender used towards the upstream: the original sender
+// rewritten with SRS so that bounces find their way back, or the fixed
+// ProxyEnvelope when SRS is not configured. Bounces keep the null sender.
+func (s *session2) envelope(conf *Config) string {
+	if conf.SRS.Enabled() && s.from == "" {
+		return ""
+	}
+	if !conf.SRS.Enabled() {
+		return conf.ProxyEnvelope
+	}
+	env, err := conf.SRS.Forward(s.from)
 	if err != nil {
-		return err
+		log.Println("[srs]", s.from, err)
+		return conf.ProxyEnvelope
 	}
+	return env
+}
+
+// rcptAddress splits a recipient as go-smtp v0.12 hands it to Rcpt: the
+// address, then whatever parameters followed it on the RCPT line. No RCPT
+// parameters are advertised, so any of them is refused, NOTIFY and ORCPT
+// included until go-smtp advertises DSN (see sendDSN).
+func rcptAddress(arg string) (string, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	addr := strings.Trim(fields[0], "<>")
+	if len(fields) > 1 {
+		return addr, fmt.Errorf("unsupported parameter %q", fields[1])
+	}
+	return addr, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the message, remembering the header From for replies
+// through sender2.
+func (s *session2) readBody(r io.Reader) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	reader := bufio.NewReader(r)
+	for {
+		line, _, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.Index(strings.ToLower(string(line)), "from") == 0 {
+			ss := strings.Split(string(line), ":")
+			if len(ss) == 2 {
+				from := ParseAddress(ss[1])
+				if len(s.to) > 0 {
+					store.Current().Set(from, s.to[0])
+				}
+			}
+		}
+		buf.Write(line)
+		buf.Write([]byte("\r\n"))
+
+		if len(line) == 0 {
+			break
+		}
+	}
+
+	if _, err := io.Copy(buf, reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// forward hands the message of g to the spool or the upstream.
+func (s *session2) forward(conf *Config, g *forwardGroup, blcnt int, body []byte) error {
+	msg := s.seal(conf, s.compose(conf, g, blcnt, body))
+
+	opts := *s.opts
+	opts.Size = len(msg)
+
+	if sp := s.be.Spool; sp != nil {
+		return sp.Enqueue(&SpoolEntry{
+			From:     s.from,
+			Envelope: g.envelope,
+			Upstream: g.upstream,
+			Rcpts:    g.rcpts,
+			Dests:    g.dests,
+			Opts:     opts,
+		}, msg)
+	}
+
+	return s.be.deliver(conf, g.upstream, g.envelope, g.dests, &opts, msg)
+}
+
+// returnBounce sends a bounce that came back to an SRS address on to the
+// original sender's MX, keeping the null sender.
+func (s *session2) returnBounce(conf *Config, ret srsReturn, blcnt int, body []byte) error {
+	_, domain := StripEmail(ret.orig)
+	if domain == "" {
+		return NewBadRecipientError(ret.orig)
+	}
+
+	g := &forwardGroup{rcpts: []string{ret.rcpt}, dests: []string{ret.orig}}
+	return deliverMX(domain, s.from, []string{ret.orig}, s.seal(conf, s.compose(conf, g, blcnt, body)), s.opts.UTF8)
+}
+
+// seal adds an ARC set with the DKIM key, so that receivers can still
+// trust the authentication results of the original hop. Without a key the
+// message goes out unsealed.
+func (s *session2) seal(conf *Config, msg []byte) []byte {
+	if conf.DkimPrivate == "" || conf.DkimDomain == "" || conf.DkimSelector == "" {
+		return msg
+	}
+	key, err := readPrivateKey(conf.DkimPrivate)
+	if err != nil {
+		log.Println("[arc] read key:", err)
+		return msg
+	}
+
+	results := s.authResults(conf).String()
+	sealed, err := ARCSeal(msg, &ARCSigner{
+		Domain:   conf.DkimDomain,
+		Selector: conf.DkimSelector,
+		Key:      key,
+	}, s.arc, results)
+	if err != nil {
+		log.Println("[arc] seal:", err)
+		return msg
+	}
+	return sealed
+}
+
+// compose prepends the trace headers for one forward group to the message.
+func (s *session2) compose(conf *Config, g *forwardGroup, blcnt int, body []byte) []byte {
+	wc := new(bytes.Buffer)
 
 	t := ""
 	if s.st.TLS.Version != 0 {
@@ -152,12 +681,19 @@ func (s *session2) Data(r io.Reader) error {
 
 	fmt.Fprintf(wc, "X-Blacklist-Count: %d (%s)\r\n", blcnt, StripPort(s.st.RemoteAddr))
 	fmt.Fprintf(wc, "Return-Path: <%s>\r\n", s.from)
-	fmt.Fprintf(wc, "X-Transfer-To: <%s>\r\n", conf.ProxyAddress)
-	fmt.Fprintf(wc, "Deliverd-To: <%s>\r\n", s.to)
+	for _, d := range g.dests {
+		fmt.Fprintf(wc, "X-Transfer-To: <%s>\r\n", d)
+	}
+	for _, to := range g.rcpts {
+		fmt.Fprintf(wc, "Deliverd-To: <%s>\r\n", to)
+	}
 
-	z := SpfHeader(s.st.RemoteAddr, s.from)
-	if z != "" {
-		fmt.Fprintf(wc, z)
+	wc.WriteString(s.authResults(conf).Header())
+	for _, t := range s.tags {
+		fmt.Fprintf(wc, "%s\r\n", t)
+	}
+	for _, q := range s.quarantine {
+		fmt.Fprintf(wc, "X-Quarantine: %s\r\n", q)
 	}
 
 	fmt.Fprintf(wc, "Received: from %s (%s %s)\r\n"+
@@ -170,50 +706,31 @@ func (s *session2) Data(r io.Reader) error {
 		conf.ServerName,
 		StripPort(s.st.LocalAddr),
 		conf.Name,
-		s.to,
+		g.rcpts[0],
 		t,
 		now(),
 	)
 
-	reader := bufio.NewReader(r)
-	for {
-		line, _, err := reader.ReadLine()
-		if err != nil {
-			break
-		}
-		if strings.Index(strings.ToLower(string(line)), "from") == 0 {
-			ss := strings.Split(string(line), ":")
-			if len(ss) == 2 {
-				from := ParseAddress(ss[1])
-				store.Current().Set(from, s.to)
-			}
-		}
-		wc.Write(line)
-		wc.Write([]byte("\r\n"))
-
-		if len(line) == 0 {
-			break
-		}
-	}
-
-	_, err = io.Copy(wc, reader)
-	if err != nil {
-		log.Println("data Coping error:", err)
-
-		wc.Close()
-		return err
-	}
+	wc.Write(body)
+	return wc.Bytes()
+}
 
-	err = wc.Close()
-	if err != nil {
-		log.Println("data Closing error:", err)
-		return err
+// authResults collects the checks run on the current message.
+func (s *session2) authResults(conf *Config) *AuthResults {
+	mailfrom := s.from
+	if mailfrom == "" {
+		mailfrom = "postmaster@" + s.st.Hostname
 	}
-
-	s.successlog()
-	return nil
+	return NewAuthResults(conf.ServerName).
+		IPRev(s.iprev, StripPort(s.st.RemoteAddr)).
+		SPF(s.spfResult, mailfrom).
+		HELO(s.spfHelo, s.st.Hostname).
+		DKIM(s.dkim).
+		DMARC(s.dmarc).
+		ARC(s.arc)
 }
 
 func (s *session2) Logout() error {
+	s.milter.Close()
 	return nil
 }
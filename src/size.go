@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"io"
+)
+
+// DefaultMaxMessageBytes is the size limit of a listener that doesn't set
+// one.
+const DefaultMaxMessageBytes = 32 << 20
+
+// sizeLimit returns the smallest of the positive limits, zero if there is
+// none.
+func sizeLimit(limits ...int) int {
+	min := 0
+	for _, l := range limits {
+		if l > 0 && (min == 0 || l < min) {
+			min = l
+		}
+	}
+	return min
+}
+
+// listenerLimit is the size limit of the listener a session came in on.
+func listenerLimit(ctx context.Context) int {
+	if l, ok := FindListener(ctx); ok {
+		return l.MaxMessageBytes
+	}
+	return 0
+}
+
+// limitReader reads from r until more than n bytes came through, then fails
+// with a 552.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func newLimitReader(r io.Reader, n int) io.Reader {
+	if n <= 0 {
+		return r
+	}
+	return &limitReader{r: r, n: int64(n)}
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, NewMessageTooLargeError()
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, NewMessageTooLargeError()
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		limit int
+		fails bool
+	}{
+		{"under", "1234", 5, false},
+		{"exact", "12345", 5, false},
+		{"one byte over", "123456", 5, true},
+		{"far over", strings.Repeat("x", 100), 5, true},
+		{"no limit", strings.Repeat("x", 100), 0, false},
+	}
+	for _, tt := range tests {
+		for _, wrap := range []func(io.Reader) io.Reader{
+			func(r io.Reader) io.Reader { return r },
+			// One byte reads catch an off-by-one at the boundary.
+			iotest.OneByteReader,
+		} {
+			r := newLimitReader(wrap(strings.NewReader(tt.input)), tt.limit)
+			got, err := ioutil.ReadAll(r)
+			if !tt.fails {
+				if err != nil || string(got) != tt.input {
+					t.Errorf("%s: ReadAll = %q, %v", tt.name, got, err)
+				}
+				continue
+			}
+			if se, ok := asSMTPError(err); !ok || se.Code != 552 {
+				t.Errorf("%s: ReadAll = %v, want a 552", tt.name, err)
+				continue
+			}
+			if len(got) > tt.limit+1 {
+				t.Errorf("%s: read %d bytes past a limit of %d", tt.name, len(got), tt.limit)
+			}
+			if _, err := r.Read(make([]byte, 10)); err == nil {
+				t.Errorf("%s: read after the limit succeeded", tt.name)
+			}
+		}
+	}
+}
+
+func TestSessionDataLimit(t *testing.T) {
+	useFakeSPF(t, nil)
+	const body = "Subject: hi\r\n\r\nhello\r\n"
+	tests := []struct {
+		name  string
+		limit int
+		code  int
+	}{
+		{"exact", len(body), 0},
+		{"one byte over", len(body) - 1, 552},
+		{"no limit", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, conns := fakeMX(t, "250 ok")
+			conf := &Config{ServerName: "mx.example.jp", ProxyAddress: "proxy@example.jp", Upstream: []Upstream{{Addr: addr, Security: SecurityNone}}}
+			ctx := SetListener(SetConfig(context.Background(), conf), &Listener{MaxMessageBytes: tt.limit})
+			s := &session{
+				be:   NewBackend(conf),
+				st:   &smtp.ConnectionState{Hostname: "client.example", RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, LocalAddr: &net.TCPAddr{}},
+				ctx:  ctx,
+				opts: &smtp.MailOptions{},
+				from: "a@example.net",
+				to:   "b@example.jp",
+			}
+
+			err := s.Data(strings.NewReader(body))
+			if tt.code == 0 {
+				if err != nil || atomic.LoadInt32(conns) != 1 {
+					t.Fatalf("Data = %v, %d connections", err, atomic.LoadInt32(conns))
+				}
+				return
+			}
+			if se, ok := asSMTPError(err); !ok || se.Code != tt.code {
+				t.Fatalf("Data = %v, want %d", err, tt.code)
+			}
+			if n := atomic.LoadInt32(conns); n != 0 {
+				t.Errorf("upstream dialed %d times for a refused message", n)
+			}
+		})
+	}
+}
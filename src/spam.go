@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanner scores a message for spam.
+type Scanner interface {
+	Scan(msg []byte, env *ScanEnvelope) (*ScanResult, error)
+}
+
+// ScanEnvelope is what a scanner is told about the message besides its
+// content. Scanners that can't use a field ignore it.
+type ScanEnvelope struct {
+	From  string
+	Rcpts []string
+	IP    string
+	Helo  string
+}
+
+// ScanResult is the verdict of a scanner. Required is the scanner's own
+// spam threshold, Symbols the names of the rules that hit.
+type ScanResult struct {
+	Score    float64
+	Required float64
+	Symbols  []string
+}
+
+func (r *ScanResult) String() string {
+	return fmt.Sprintf("score=%.1f required=%.1f tests=%s", r.Score, r.Required, strings.Join(r.Symbols, ","))
+}
+
+// SpamSetting decides what happens to inbound mail by its score. A
+// threshold of zero is off, except Tag which defaults to the scanner's own
+// threshold. DefaultAction is used while the scanner fails.
+type SpamSetting struct {
+	Scanner Scanner
+	// Tag marks the message as spam in X-Spam-Status and X-Spam-Flag.
+	Tag float64
+	// Subject prefixes the Subject with SubjectTag.
+	Subject    float64
+	SubjectTag string
+	// Quarantine sends the message to Config.QuarantineTo.
+	Quarantine float64
+	// Reject refuses the message.
+	Reject        float64
+	DefaultAction PolicyAction
+}
+
+const (
+	DefaultSpamTimeout    = 30 * time.Second
+	DefaultSpamSubjectTag = "***SPAM***"
+)
+
+func (s SpamSetting) tag(r *ScanResult) float64 {
+	if s.Tag != 0 {
+		return s.Tag
+	}
+	return r.Required
+}
+
+// spamHeaders are the fields we add, any copy of them coming in is
+// removed first.
+var spamHeaders = []string{"X-Spam-Status", "X-Spam-Score", "X-Spam-Flag"}
+
+// headers returns the X-Spam fields for r.
+func (s SpamSetting) headers(r *ScanResult) []string {
+	status, flag := "No", ""
+	if r.Score >= s.tag(r) {
+		status, flag = "Yes", "X-Spam-Flag: YES"
+	}
+	h := []string{
+		fmt.Sprintf("X-Spam-Status: %s, score=%.1f required=%.1f tests=%s", status, r.Score, s.tag(r), strings.Join(r.Symbols, ",")),
+		fmt.Sprintf("X-Spam-Score: %.1f", r.Score),
+	}
+	if flag != "" {
+		h = append(h, flag)
+	}
+	return h
+}
+
+// stripFields removes the header fields named in names.
+func stripFields(msg []byte, names ...string) []byte {
+	fields, body := splitMessage(msg)
+
+	removed := 0
+	out := new(bytes.Buffer)
+	for _, f := range fields {
+		if containsFold(names, fieldName(f)) {
+			removed++
+			continue
+		}
+		out.WriteString(f)
+	}
+	if removed == 0 {
+		return msg
+	}
+
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteSubject puts tag in front of the Subject, adding one if the
+// message has none.
+func rewriteSubject(msg []byte, tag string) []byte {
+	fields, body := splitMessage(msg)
+
+	found := false
+	out := new(bytes.Buffer)
+	for _, f := range fields {
+		if !found && strings.EqualFold(fieldName(f), "Subject") {
+			found = true
+			f = "Subject: " + tag + " " + strings.TrimLeft(fieldValue(f), " \t")
+		}
+		out.WriteString(f)
+	}
+	if !found {
+		fmt.Fprintf(out, "Subject: %s\r\n", tag)
+	}
+
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
+
+// SpamdScanner asks SpamAssassin's spamd with the SYMBOLS command.
+type SpamdScanner struct {
+	Network string
+	Address string
+	// User selects the spamd per-user preferences, empty for the default.
+	User    string
+	Timeout time.Duration
+}
+
+func (sc *SpamdScanner) Scan(msg []byte, env *ScanEnvelope) (*ScanResult, error) {
+	timeout := sc.Timeout
+	if timeout == 0 {
+		timeout = DefaultSpamTimeout
+	}
+	conn, err := net.DialTimeout(sc.Network, sc.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(msg))
+	if sc.User != "" {
+		fmt.Fprintf(w, "User: %s\r\n", sc.User)
+	}
+	w.WriteString("\r\n")
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tr.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "SPAMD/") {
+		return nil, fmt.Errorf("spamd: bad reply %q", line)
+	}
+	if f[1] != "0" {
+		return nil, fmt.Errorf("spamd: %s", strings.Join(f[1:], " "))
+	}
+	h, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Spam: True ; 15.0 / 5.0
+	r := &ScanResult{}
+	spam := h.Get("Spam")
+	l := strings.IndexByte(spam, ';')
+	if l < 0 {
+		return nil, fmt.Errorf("spamd: bad Spam header %q", spam)
+	}
+	scores := strings.Split(spam[l+1:], "/")
+	if len(scores) != 2 {
+		return nil, fmt.Errorf("spamd: bad Spam header %q", spam)
+	}
+	if r.Score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64); err != nil {
+		return nil, fmt.Errorf("spamd: bad Spam header %q", spam)
+	}
+	if r.Required, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64); err != nil {
+		return nil, fmt.Errorf("spamd: bad Spam header %q", spam)
+	}
+
+	symbols, err := ioutil.ReadAll(tr.R)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(strings.TrimSpace(string(symbols)), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			r.Symbols = append(r.Symbols, s)
+		}
+	}
+	return r, nil
+}
+
+// RspamdScanner posts the message to the /checkv2 endpoint of rspamd's
+// normal worker.
+type RspamdScanner struct {
+	// URL is the base URL of the worker, such as http://localhost:11333.
+	URL      string
+	Password string
+	Timeout  time.Duration
+}
+
+type rspamdReply struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+	Error string `json:"error"`
+}
+
+func (sc *RspamdScanner) Scan(msg []byte, env *ScanEnvelope) (*ScanResult, error) {
+	timeout := sc.Timeout
+	if timeout == 0 {
+		timeout = DefaultSpamTimeout
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(sc.URL, "/")+"/checkv2", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	if sc.Password != "" {
+		req.Header.Set("Password", sc.Password)
+	}
+	if env != nil {
+		if env.From != "" {
+			req.Header.Set("From", env.From)
+		}
+		for _, to := range env.Rcpts {
+			req.Header.Add("Rcpt", to)
+		}
+		if env.IP != "" {
+			req.Header.Set("IP", env.IP)
+		}
+		if env.Helo != "" {
+			req.Header.Set("Helo", env.Helo)
+		}
+	}
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply rspamdReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("rspamd: %s: %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || reply.Error != "" {
+		return nil, fmt.Errorf("rspamd: %s: %s", resp.Status, reply.Error)
+	}
+
+	r := &ScanResult{Score: reply.Score, Required: reply.RequiredScore}
+	for name := range reply.Symbols {
+		r.Symbols = append(r.Symbols, name)
+	}
+	sort.Strings(r.Symbols)
+	return r, nil
+}
+
+// ParseScannerAddress accepts "unix:/path", a plain "/path" and
+// "host:port" for spamd and clamd.
+func ParseScannerAddress(s string) (string, string, error) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", s[len("unix:"):], nil
+	}
+	if strings.HasPrefix(s, "/") {
+		return "unix", s, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
+
+// FakeScanner returns a fixed verdict without looking at the message,
+// for tests and for trying out thresholds.
+type FakeScanner struct {
+	Result ScanResult
+	Err    error
+}
+
+func (sc *FakeScanner) Scan(msg []byte, env *ScanEnvelope) (*ScanResult, error) {
+	if sc.Err != nil {
+		return nil, sc.Err
+	}
+	r := sc.Result
+	return &r, nil
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// fakeSpamd reads one SYMBOLS request and answers with reply.
+func fakeSpamd(t *testing.T, reply string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tr := textproto.NewReader(bufio.NewReader(c))
+		if line, _ := tr.ReadLine(); line != "SYMBOLS SPAMC/1.5" {
+			return
+		}
+		h, err := tr.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		var n int
+		fmt.Sscan(h.Get("Content-Length"), &n)
+		io.CopyN(ioutil.Discard, tr.R, int64(n))
+		c.Write([]byte(reply))
+	}()
+	return ln.Addr().String()
+}
+
+func TestSpamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    string
+		wantErr bool
+	}{
+		{"spam", "SPAMD/1.1 0 EX_OK\r\nContent-length: 24\r\nSpam: True ; 15.2 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK,X\r\n",
+			"score=15.2 required=5.0 tests=BAYES_99,URIBL_BLACK,X", false},
+		{"ham without symbols", "SPAMD/1.1 0 EX_OK\r\nSpam: False ; -1.0 / 5.0\r\n\r\n",
+			"score=-1.0 required=5.0 tests=", false},
+		{"no body", "SPAMD/1.1 0 EX_OK\r\nSpam: False ; 0.0 / 5.0\r\n", "score=0.0 required=5.0 tests=", false},
+		{"spamd error", "SPAMD/1.0 76 Bad header line\r\n", "", true},
+		{"not spamd", "HTTP/1.1 200 OK\r\n", "", true},
+		{"missing Spam", "SPAMD/1.1 0 EX_OK\r\n\r\n", "", true},
+		{"bad score", "SPAMD/1.1 0 EX_OK\r\nSpam: True ; lots / 5.0\r\n\r\n", "", true},
+		{"missing threshold", "SPAMD/1.1 0 EX_OK\r\nSpam: True ; 15.0\r\n\r\n", "", true},
+		{"closed", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &SpamdScanner{Network: "tcp", Address: fakeSpamd(t, tt.reply)}
+			r, err := sc.Scan([]byte("Subject: hi\r\n\r\nbody\r\n"), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %s", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.String() != tt.want {
+				t.Errorf("result %s, want %s", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestRspamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		reply   string
+		want    string
+		wantErr bool
+	}{
+		{"spam", 200, `{"score": 12.5, "required_score": 15, "symbols": {"Z_LAST": {"score": 1}, "A_FIRST": {"score": 2}}}`,
+			"score=12.5 required=15.0 tests=A_FIRST,Z_LAST", false},
+		{"ham", 200, `{"score": 0, "required_score": 15}`, "score=0.0 required=15.0 tests=", false},
+		{"error field", 200, `{"error": "message has no body"}`, "", true},
+		{"http error", 403, `{"error": "unauthorized"}`, "", true},
+		{"not json", 200, `<html>`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/checkv2" {
+					http.NotFound(w, r)
+					return
+				}
+				got = r.Header
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.reply)
+			}))
+			defer srv.Close()
+
+			sc := &RspamdScanner{URL: srv.URL + "/", Password: "secret"}
+			env := &ScanEnvelope{From: "a@example.net", Rcpts: []string{"b@example.org", "c@example.org"}, IP: "192.0.2.1", Helo: "client.example"}
+			r, err := sc.Scan([]byte("Subject: hi\r\n\r\nbody\r\n"), env)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %s", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.String() != tt.want {
+				t.Errorf("result %s, want %s", r, tt.want)
+			}
+			if got.Get("Password") != "secret" || got.Get("From") != "a@example.net" || len(got["Rcpt"]) != 2 ||
+				got.Get("Ip") != "192.0.2.1" || got.Get("Helo") != "client.example" {
+				t.Errorf("request headers %v", got)
+			}
+		})
+	}
+}
+
+func TestCheckSpam(t *testing.T) {
+	msg := []byte("Subject: hi\r\nX-Spam-Flag: YES\r\n\r\nbody\r\n")
+	setting := SpamSetting{Subject: 8, SubjectTag: DefaultSpamSubjectTag, Quarantine: 10, Reject: 15}
+	result := func(score float64) *FakeScanner {
+		return &FakeScanner{Result: ScanResult{Score: score, Required: 5, Symbols: []string{"A", "B"}}}
+	}
+
+	tests := []struct {
+		name       string
+		scanner    *FakeScanner
+		action     PolicyAction
+		tag        float64
+		code       int
+		subject    string
+		flagged    bool
+		quarantine bool
+	}{
+		{"ham", result(1), "", 0, 0, "hi", false, false},
+		{"tagged at the scanner threshold", result(5), "", 0, 0, "hi", true, false},
+		{"own tag threshold", result(5), "", 6, 0, "hi", false, false},
+		{"subject rewritten", result(8), "", 0, 0, "***SPAM*** hi", true, false},
+		{"quarantined", result(12), "", 0, 0, "***SPAM*** hi", true, true},
+		{"rejected", result(15), "", 0, 550, "", false, false},
+		{"scanner down, accept", &FakeScanner{Err: errors.New("down")}, ActionAccept, 0, 0, "hi", false, false},
+		{"scanner down, tempfail", &FakeScanner{Err: errors.New("down")}, ActionTempfail, 0, 451, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := setting
+			sp.Scanner, sp.DefaultAction, sp.Tag = tt.scanner, tt.action, tt.tag
+			s := &session2{
+				st:   &smtp.ConnectionState{Hostname: "client.example", RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}},
+				from: "a@example.net",
+				to:   []string{"b@example.org"},
+			}
+
+			body, err := s.checkSpam(&Config{Spam: sp}, msg)
+			if tt.code != 0 {
+				se, ok := asSMTPError(err)
+				if !ok || se.Code != tt.code {
+					t.Fatalf("err = %v, want %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(string(body), "X-Spam-Flag") {
+				t.Error("incoming X-Spam-Flag kept")
+			}
+			if got := headerValue(body, "Subject"); got != tt.subject {
+				t.Errorf("Subject = %q, want %q", got, tt.subject)
+			}
+			flagged := false
+			for _, h := range s.tags {
+				flagged = flagged || h == "X-Spam-Flag: YES"
+			}
+			if flagged != tt.flagged {
+				t.Errorf("tags = %q", s.tags)
+			}
+			if (len(s.quarantine) > 0) != tt.quarantine {
+				t.Errorf("quarantine = %q", s.quarantine)
+			}
+		})
+	}
+}
+
+func TestRewriteSubject(t *testing.T) {
+	tests := []struct {
+		msg, want string
+	}{
+		{"Subject: hi\r\n\r\nbody", "Subject: [S] hi\r\n\r\nbody"},
+		{"subject:   hi\r\n\r\nbody", "Subject: [S] hi\r\n\r\nbody"},
+		{"From: a\r\n\r\nbody", "From: a\r\nSubject: [S]\r\n\r\nbody"},
+	}
+	for _, tt := range tests {
+		if got := string(rewriteSubject([]byte(tt.msg), "[S]")); got != tt.want {
+			t.Errorf("rewriteSubject(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestParseScannerAddress(t *testing.T) {
+	tests := []struct {
+		in, network, addr string
+		ok                bool
+	}{
+		{"unix:/run/spamd.sock", "unix", "/run/spamd.sock", true},
+		{"/run/clamd.ctl", "unix", "/run/clamd.ctl", true},
+		{"127.0.0.1:783", "tcp", "127.0.0.1:783", true},
+		{"localhost", "", "", false},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseScannerAddress(tt.in)
+		if (err == nil) != tt.ok || network != tt.network || addr != tt.addr {
+			t.Errorf("ParseScannerAddress(%q) = %q, %q, %v", tt.in, network, addr, err)
+		}
+	}
+}
+
+// headerValue returns the trimmed value of the first field called name.
+func headerValue(msg []byte, name string) string {
+	fields, _ := splitMessage(msg)
+	for _, f := range fields {
+		if strings.EqualFold(fieldName(f), name) {
+			return strings.TrimSpace(fieldValue(f))
+		}
+	}
+	return ""
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"strings"
 
@@ -22,7 +21,60 @@ func ParseAddr(addr net.Addr) (net.IP, error) {
 	}
 }
 
-func SpfHeader(addr net.Addr, from string) string {
+// SPFSetting maps SPF results to what happens to the message. Neutral is
+// handled like none, pass is always accepted and unset entries accept.
+type SPFSetting struct {
+	Fail      PolicyAction
+	Softfail  PolicyAction
+	PermError PolicyAction
+	TempError PolicyAction
+	None      PolicyAction
+}
+
+// DefaultSPF fills the entries missing from a configured spf section.
+var DefaultSPF = SPFSetting{
+	Fail:      ActionReject,
+	Softfail:  ActionTag,
+	PermError: ActionTag,
+	TempError: ActionTempfail,
+	None:      ActionAccept,
+}
+
+func (s SPFSetting) Action(r spf.Result) PolicyAction {
+	var a PolicyAction
+	switch r {
+	case spf.Fail:
+		a = s.Fail
+	case spf.Softfail:
+		a = s.Softfail
+	case spf.PermError:
+		a = s.PermError
+	case spf.TempError:
+		a = s.TempError
+	case spf.None, spf.Neutral:
+		a = s.None
+	}
+	if a == "" {
+		return ActionAccept
+	}
+	return a
+}
+
+var checkHost = spf.CheckHost
+
+// CheckSPF evaluates the MAIL FROM identity (RFC 7208). The null sender
+// has none, its result is that of CheckSPFHelo.
+func CheckSPF(ip net.IP, from, helo string) spf.Result {
+	_, domain := StripEmail(from)
+	return checkHost(ip, domain, from, helo)
+}
+
+// CheckSPFHelo evaluates the HELO identity.
+func CheckSPFHelo(ip net.IP, helo string) spf.Result {
+	return checkHost(ip, helo, "postmaster@"+helo, helo)
+}
+
+func SpfHeader(servID string, addr net.Addr, from, helo string) string {
 	var ip net.IP
 	ip, err := ParseAddr(addr)
 	if err != nil {
@@ -30,9 +82,9 @@ func SpfHeader(addr net.Addr, from string) string {
 	}
 
 	_, host := StripEmail(from)
-	r := spf.CheckHost(ip, host, from, "")
+	r := checkHost(ip, host, from, helo)
 
-	return fmt.Sprintf("Authentication-Results: spf=%s ( %s )\r\n", r.String(), from)
+	return NewAuthResults(servID).SPF(r, from).Header()
 }
 
 func ParseAddress(s string) string {
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/mileusna/spf"
+)
+
+func TestSPFAction(t *testing.T) {
+	custom := SPFSetting{Fail: ActionTag, Softfail: ActionReject, TempError: ActionAccept}
+	tests := []struct {
+		result      spf.Result
+		def, custom PolicyAction
+	}{
+		{spf.Pass, ActionAccept, ActionAccept},
+		{spf.Fail, ActionReject, ActionTag},
+		{spf.Softfail, ActionTag, ActionReject},
+		{spf.PermError, ActionTag, ActionAccept},
+		{spf.TempError, ActionTempfail, ActionAccept},
+		{spf.Neutral, ActionAccept, ActionAccept},
+		{spf.None, ActionAccept, ActionAccept},
+	}
+	for _, tt := range tests {
+		if got := DefaultSPF.Action(tt.result); got != tt.def {
+			t.Errorf("DefaultSPF.Action(%s) = %s, want %s", tt.result, got, tt.def)
+		}
+		if got := custom.Action(tt.result); got != tt.custom {
+			t.Errorf("Action(%s) = %s, want %s", tt.result, got, tt.custom)
+		}
+	}
+}
+
+// useFakeSPF makes the SPF check of each domain return its result in
+// results, none for the others.
+func useFakeSPF(t *testing.T, results map[string]spf.Result) {
+	old := checkHost
+	checkHost = func(ip net.IP, domain, sender, helo string) spf.Result {
+		if r, ok := results[domain]; ok {
+			return r
+		}
+		return spf.None
+	}
+	t.Cleanup(func() { checkHost = old })
+}
+
+func TestSessionSPF(t *testing.T) {
+	tests := []struct {
+		name       string
+		setting    SPFSetting
+		from       string
+		helo, mail spf.Result
+		code       int
+		message    string
+		tag        string
+	}{
+		{"pass", DefaultSPF, "a@example.net", spf.None, spf.Pass, 0, "", ""},
+		{"fail", DefaultSPF, "a@example.net", spf.None, spf.Fail, 550, "example.net (fail)", ""},
+		{"softfail", DefaultSPF, "a@example.net", spf.None, spf.Softfail, 0, "", "X-SPF-Policy: softfail (example.net)"},
+		{"permerror", DefaultSPF, "a@example.net", spf.None, spf.PermError, 0, "", "X-SPF-Policy: permerror (example.net)"},
+		{"temperror", DefaultSPF, "a@example.net", spf.None, spf.TempError, 451, "example.net (temperror)", ""},
+		{"fail tagged", SPFSetting{Fail: ActionTag}, "a@example.net", spf.None, spf.Fail, 0, "", "X-SPF-Policy: fail (example.net)"},
+		{"softfail rejected", SPFSetting{Softfail: ActionReject}, "a@example.net", spf.None, spf.Softfail, 550, "example.net (softfail)", ""},
+		{"permerror tempfailed", SPFSetting{PermError: ActionTempfail}, "a@example.net", spf.None, spf.PermError, 451, "example.net (permerror)", ""},
+		{"helo fail overrides sender pass", DefaultSPF, "a@example.net", spf.Fail, spf.Pass, 550, "client.example (fail)", ""},
+		{"helo softfail ignored with a sender", DefaultSPF, "a@example.net", spf.Softfail, spf.Pass, 0, "", ""},
+		{"null sender helo fail", DefaultSPF, "", spf.Fail, spf.None, 550, "client.example (fail)", ""},
+		{"null sender helo temperror", DefaultSPF, "", spf.TempError, spf.None, 451, "client.example (temperror)", ""},
+		{"null sender helo pass", DefaultSPF, "", spf.Pass, spf.None, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeSPF(t, map[string]spf.Result{"client.example": tt.helo, "example.net": tt.mail})
+			conf := &Config{
+				SPF:        tt.setting,
+				SRS:        testSRS,
+				Allocation: AllocationSetting{ToDomains: map[string]bool{"example.org": true}},
+			}
+			s := &session2{
+				be:  &Backend{},
+				st:  &smtp.ConnectionState{Hostname: "client.example", RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}},
+				ctx: SetConfig(context.Background(), conf),
+			}
+			if err := s.Mail(tt.from, smtp.MailOptions{}); err != nil {
+				t.Fatalf("Mail = %v", err)
+			}
+			if tag := strings.Join(s.tags, "\n"); tag != tt.tag {
+				t.Errorf("tags = %q, want %q", tag, tt.tag)
+			}
+
+			err := s.Rcpt("b@example.org")
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("Rcpt = %v", err)
+				}
+				return
+			}
+			if se, ok := asSMTPError(err); !ok || se.Code != tt.code || !strings.Contains(se.Message, tt.message) {
+				t.Fatalf("Rcpt = %v, want %d %s", err, tt.code, tt.message)
+			}
+		})
+	}
+}
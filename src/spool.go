@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+type SpoolSetting struct {
+	Dir string
+	// MaxLifetime is how long a message may stay queued before it is
+	// returned to the sender.
+	MaxLifetime time.Duration
+	// Retries wait RetryBase, doubled per attempt, up to RetryMax.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	// DelayWarning is how long a message may stay queued before the
+	// sender is told it is delayed.
+	DelayWarning time.Duration
+}
+
+var DefaultSpool = SpoolSetting{
+	MaxLifetime:  5 * 24 * time.Hour,
+	RetryBase:    time.Minute,
+	RetryMax:     time.Hour,
+	DelayWarning: 4 * time.Hour,
+}
+
+// SpoolEntry is the envelope of a queued message. It is stored as a JSON
+// line in front of the message in the queue file.
+type SpoolEntry struct {
+	ID       string
+	Created  time.Time
+	From     string
+	Envelope string
+	Upstream string
+	Rcpts    []string
+	Dests    []string
+	Opts     smtp.MailOptions
+
+	attempts int
+	next     time.Time
+	busy     bool
+	warned   bool
+}
+
+// Spool keeps accepted inbound messages on disk until the upstream has
+// taken them. Queue files are written to tmp/, synced and renamed into
+// queue/, so a crash leaves either a complete entry or nothing.
+type Spool struct {
+	SpoolSetting
+
+	be      *Backend
+	mu      sync.Mutex
+	entries map[string]*SpoolEntry
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func OpenSpool(be *Backend, setting SpoolSetting) (*Spool, error) {
+	if setting.MaxLifetime == 0 {
+		setting.MaxLifetime = DefaultSpool.MaxLifetime
+	}
+	if setting.RetryBase == 0 {
+		setting.RetryBase = DefaultSpool.RetryBase
+	}
+	if setting.RetryMax == 0 {
+		setting.RetryMax = DefaultSpool.RetryMax
+	}
+	if setting.DelayWarning == 0 {
+		setting.DelayWarning = DefaultSpool.DelayWarning
+	}
+
+	sp := &Spool{
+		SpoolSetting: setting,
+		be:           be,
+		entries:      map[string]*SpoolEntry{},
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+
+	for _, d := range []string{sp.tmpDir(), sp.queueDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sp.recover(); err != nil {
+		return nil, err
+	}
+
+	be.Spool = sp
+	return sp, nil
+}
+
+func (sp *Spool) tmpDir() string {
+	return filepath.Join(sp.Dir, "tmp")
+}
+
+func (sp *Spool) queueDir() string {
+	return filepath.Join(sp.Dir, "queue")
+}
+
+// recover drops half written files and loads every complete queue entry.
+func (sp *Spool) recover() error {
+	tmp, err := ioutil.ReadDir(sp.tmpDir())
+	if err != nil {
+		return err
+	}
+	for _, fi := range tmp {
+		log.Println("[spool] removing incomplete", fi.Name())
+		os.Remove(filepath.Join(sp.tmpDir(), fi.Name()))
+	}
+
+	queue, err := ioutil.ReadDir(sp.queueDir())
+	if err != nil {
+		return err
+	}
+	for _, fi := range queue {
+		if filepath.Ext(fi.Name()) == ".bad" {
+			continue
+		}
+		e, _, err := sp.read(fi.Name())
+		if err != nil {
+			log.Println("[spool] corrupt entry", fi.Name(), err)
+			sp.setAside(fi.Name())
+			continue
+		}
+		sp.entries[e.ID] = e
+	}
+
+	if len(sp.entries) > 0 {
+		log.Printf("[spool] recovered %d queued messages\n", len(sp.entries))
+	}
+	return nil
+}
+
+func (sp *Spool) read(id string) (*SpoolEntry, []byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(sp.queueDir(), id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := bytes.IndexByte(b, '\n')
+	if l < 0 {
+		return nil, nil, errors.New("missing envelope")
+	}
+
+	e := new(SpoolEntry)
+	if err := json.Unmarshal(b[:l], e); err != nil {
+		return nil, nil, err
+	}
+	if e.ID != id {
+		return nil, nil, errors.New("envelope id mismatch")
+	}
+	return e, b[l+1:], nil
+}
+
+// Enqueue stores msg durably. Once it returns nil the message may be
+// acknowledged to the client.
+func (sp *Spool) Enqueue(e *SpoolEntry, msg []byte) error {
+	e.ID = uuid.New().String()
+	e.Created = time.Now()
+
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return NewError(err)
+	}
+
+	tmp := filepath.Join(sp.tmpDir(), e.ID)
+	if err := writeSync(tmp, meta, msg); err != nil {
+		os.Remove(tmp)
+		log.Println("[spool] write error:", err)
+		return NewError(errors.New("queue write failed"))
+	}
+	if err := os.Rename(tmp, filepath.Join(sp.queueDir(), e.ID)); err != nil {
+		os.Remove(tmp)
+		log.Println("[spool] write error:", err)
+		return NewError(errors.New("queue write failed"))
+	}
+	syncDir(sp.queueDir())
+
+	sp.mu.Lock()
+	sp.entries[e.ID] = e
+	sp.mu.Unlock()
+
+	log.Printf("[spool] queued %s %s -> %v\n", e.ID, e.From, e.Dests)
+	sp.notify()
+	return nil
+}
+
+func writeSync(path string, meta, msg []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	w.Write(meta)
+	w.WriteByte('\n')
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (sp *Spool) notify() {
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start delivers queued messages in the background until Close is called.
+func (sp *Spool) Start() {
+	// Added before the goroutine runs so that an early Close waits for it.
+	sp.wg.Add(1)
+	go sp.run()
+}
+
+func (sp *Spool) run() {
+	defer sp.wg.Done()
+
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for {
+		sp.flush()
+
+		select {
+		case <-sp.done:
+			return
+		case <-sp.wake:
+		case <-t.C:
+		}
+	}
+}
+
+func (sp *Spool) Close() {
+	close(sp.done)
+	sp.wg.Wait()
+}
+
+// Len returns the number of queued messages.
+func (sp *Spool) Len() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return len(sp.entries)
+}
+
+func (sp *Spool) flush() {
+	now := time.Now()
+
+	var due []*SpoolEntry
+	sp.mu.Lock()
+	for _, e := range sp.entries {
+		if !e.busy && !now.Before(e.next) {
+			e.busy = true
+			due = append(due, e)
+		}
+	}
+	sp.mu.Unlock()
+
+	for _, e := range due {
+		select {
+		case <-sp.done:
+			sp.release(due)
+			return
+		default:
+		}
+		sp.attempt(e)
+	}
+}
+
+func (sp *Spool) release(list []*SpoolEntry) {
+	sp.mu.Lock()
+	for _, e := range list {
+		e.busy = false
+	}
+	sp.mu.Unlock()
+}
+
+func (sp *Spool) attempt(e *SpoolEntry) {
+	_, msg, err := sp.read(e.ID)
+	if err != nil {
+		log.Println("[spool] read error", e.ID, err)
+		sp.setAside(e.ID)
+		sp.mu.Lock()
+		delete(sp.entries, e.ID)
+		sp.mu.Unlock()
+		return
+	}
+
+	conf := sp.be.CurrentConfig()
+	opts := e.Opts
+	err = sp.be.deliver(conf, e.Upstream, e.Envelope, e.Dests, &opts, msg)
+	switch {
+	case err == nil:
+		log.Printf("[spool] delivered %s %s -> %v\n", e.ID, e.From, e.Dests)
+		sp.remove(e)
+	case permanentError(err):
+		log.Printf("[spool] rejected %s %s -> %v: %s\n", e.ID, e.From, e.Dests, diagnostic(err))
+		sp.bounce(e, msg, err, true)
+		sp.remove(e)
+	case time.Since(e.Created) > sp.MaxLifetime:
+		log.Printf("[spool] expired %s %s -> %v: %s\n", e.ID, e.From, e.Dests, diagnostic(err))
+		sp.bounce(e, msg, err, false)
+		sp.remove(e)
+	default:
+		warn := !e.warned && time.Since(e.Created) > sp.DelayWarning
+		sp.mu.Lock()
+		e.attempts++
+		e.next = time.Now().Add(sp.backoff(e.attempts))
+		e.busy = false
+		e.warned = e.warned || warn
+		sp.mu.Unlock()
+		log.Printf("[spool] deferred %s %s -> %v until %s: %s\n", e.ID, e.From, e.Dests, e.next.Format(time.RFC3339), diagnostic(err))
+		// The warning isn't recorded in the queue file, a restart may
+		// send it once more.
+		if warn {
+			sendDSN(conf, e.From, dsnRecipients(e.Rcpts, "delayed", statusFor(err, false), diagnostic(err)), msg)
+		}
+	}
+}
+
+func (sp *Spool) backoff(attempts int) time.Duration {
+	d := sp.RetryBase
+	for i := 1; i < attempts && d < sp.RetryMax; i++ {
+		d *= 2
+	}
+	if d > sp.RetryMax {
+		d = sp.RetryMax
+	}
+	return d
+}
+
+func (sp *Spool) remove(e *SpoolEntry) {
+	os.Remove(filepath.Join(sp.queueDir(), e.ID))
+
+	sp.mu.Lock()
+	delete(sp.entries, e.ID)
+	sp.mu.Unlock()
+}
+
+// setAside renames an unreadable queue file to .bad, where it is skipped
+// but kept for the operator.
+func (sp *Spool) setAside(name string) {
+	path := filepath.Join(sp.queueDir(), name)
+	os.Rename(path, path+".bad")
+}
+
+// bounce returns a failure DSN to the original sender. Bounces are never
+// sent for the null sender.
+func (sp *Spool) bounce(e *SpoolEntry, msg []byte, err error, permanent bool) {
+	status := statusFor(err, permanent)
+	if !permanent {
+		status = "4.4.7"
+	}
+	rcpts := dsnRecipients(e.Rcpts, "failed", "5"+status[1:], diagnostic(err))
+	sendDSN(sp.be.CurrentConfig(), e.From, rcpts, msg)
+}
+
+// diagnostic unwraps err to the upstream's reply where there is one.
+func diagnostic(err error) string {
+	if se, ok := asSMTPError(err); ok {
+		return fmt.Sprintf("%d %d.%d.%d %s", se.Code, se.EnhancedCode[0], se.EnhancedCode[1], se.EnhancedCode[2], se.Message)
+	}
+	return err.Error()
+}
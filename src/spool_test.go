@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSpool(t *testing.T, files map[string]string) *Spool {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sp, err := OpenSpool(&Backend{}, SpoolSetting{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSpoolRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		loaded  bool
+		kept    string
+	}{
+		{"complete", "queue/a1", `{"ID":"a1","From":"x@example.net"}` + "\nSubject: hi\r\n\r\n", true, "queue/a1"},
+		{"half written", "tmp/a2", `{"ID":"a2"}` + "\n", false, ""},
+		{"missing envelope", "queue/a3", `{"ID":"a3"}`, false, "queue/a3.bad"},
+		{"bad json", "queue/a4", "{\nSubject: hi\r\n", false, "queue/a4.bad"},
+		{"id mismatch", "queue/a5", `{"ID":"other"}` + "\n", false, "queue/a5.bad"},
+		{"already bad", "queue/a6.bad", "garbage", false, "queue/a6.bad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := openTestSpool(t, map[string]string{tt.file: tt.content})
+
+			if got := sp.Len() == 1; got != tt.loaded {
+				t.Errorf("loaded = %v, want %v", got, tt.loaded)
+			}
+			if tt.kept != "" && !exists(filepath.Join(sp.Dir, tt.kept)) {
+				t.Errorf("%s is missing", tt.kept)
+			}
+			if tt.kept != tt.file && exists(filepath.Join(sp.Dir, tt.file)) {
+				t.Errorf("%s is still there", tt.file)
+			}
+		})
+	}
+}
+
+func TestSpoolAttemptUnreadable(t *testing.T) {
+	sp := openTestSpool(t, map[string]string{
+		"queue/b1": `{"ID":"b1"}` + "\nSubject: hi\r\n\r\n",
+	})
+	path := filepath.Join(sp.queueDir(), "b1")
+	if err := ioutil.WriteFile(path, []byte("truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sp.attempt(sp.entries["b1"])
+	if sp.Len() != 0 {
+		t.Error("entry still queued")
+	}
+	if !exists(path + ".bad") {
+		t.Error("queue file was not kept as .bad")
+	}
+}
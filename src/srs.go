@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SRSSetting configures the Sender Rewriting Scheme. Forwarded mail gets an
+// envelope sender in Domain, signed with the first of Secrets; the others
+// are still accepted when reversing so secrets can be rotated.
+type SRSSetting struct {
+	Domain  string
+	Secrets []string
+	// MaxAge is the number of days a rewritten address stays valid.
+	MaxAge int
+}
+
+const (
+	srsHashLength = 4
+	srsBase32     = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	srsDefaultAge = 21
+)
+
+var (
+	ErrSRSNotOurs   = errors.New("srs: not an SRS address of ours")
+	ErrSRSHash      = errors.New("srs: hash mismatch")
+	ErrSRSTimestamp = errors.New("srs: address expired")
+	ErrSRSSyntax    = errors.New("srs: malformed address")
+)
+
+func (s SRSSetting) Enabled() bool {
+	return s.Domain != "" && len(s.Secrets) > 0
+}
+
+func (s SRSSetting) maxAge() int {
+	if s.MaxAge <= 0 {
+		return srsDefaultAge
+	}
+	return s.MaxAge
+}
+
+// IsSRS reports whether the local part of addr is SRS0 or SRS1 encoded.
+func IsSRS(addr string) bool {
+	local, _ := StripEmail(addr)
+	return srsKind(local) != ""
+}
+
+func srsKind(local string) string {
+	if len(local) < 5 || !strings.ContainsAny(local[4:5], "=+-") {
+		return ""
+	}
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		return "SRS0"
+	case "SRS1":
+		return "SRS1"
+	}
+	return ""
+}
+
+// Forward rewrites a sender for forwarding. Plain addresses become SRS0,
+// SRS0 addresses of other forwarders become SRS1 and SRS1 addresses keep
+// their original forwarder with a new hash.
+func (s SRSSetting) Forward(addr string) (string, error) {
+	local, host := StripEmail(addr)
+	if host == "" {
+		return "", ErrSRSSyntax
+	}
+	if strings.EqualFold(host, s.Domain) {
+		return addr, nil
+	}
+
+	switch srsKind(local) {
+	case "SRS0":
+		rest := local[4:]
+		return "SRS1=" + s.hash(s.Secrets[0], host, rest) + "=" + host + "=" + rest + "@" + s.Domain, nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", ErrSRSSyntax
+		}
+		first, rest := parts[1], parts[2]
+		return "SRS1=" + s.hash(s.Secrets[0], first, rest) + "=" + first + "=" + rest + "@" + s.Domain, nil
+	}
+
+	ts := srsTimestamp(time.Now())
+	return "SRS0=" + s.hash(s.Secrets[0], ts, host, local) + "=" + ts + "=" + host + "=" + local + "@" + s.Domain, nil
+}
+
+// Reverse recovers the address a bounce to an SRS address has to go to.
+func (s SRSSetting) Reverse(addr string) (string, error) {
+	local, host := StripEmail(addr)
+	if host == "" || !strings.EqualFold(host, s.Domain) {
+		return "", ErrSRSNotOurs
+	}
+
+	switch srsKind(local) {
+	case "SRS0":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 {
+			return "", ErrSRSSyntax
+		}
+		hash, ts, ohost, olocal := parts[0], parts[1], parts[2], parts[3]
+		if !s.verify(hash, ts, ohost, olocal) {
+			return "", ErrSRSHash
+		}
+		if !srsTimestampValid(ts, time.Now(), s.maxAge()) {
+			return "", ErrSRSTimestamp
+		}
+		return olocal + "@" + ohost, nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", ErrSRSSyntax
+		}
+		hash, first, rest := parts[0], parts[1], parts[2]
+		if !s.verify(hash, first, rest) {
+			return "", ErrSRSHash
+		}
+		return "SRS0" + rest + "@" + first, nil
+	}
+	return "", ErrSRSNotOurs
+}
+
+func (s SRSSetting) hash(secret string, parts ...string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:srsHashLength]
+}
+
+// verify compares case-insensitively, since some MTAs lowercase the local
+// part on the way back.
+func (s SRSSetting) verify(hash string, parts ...string) bool {
+	for _, secret := range s.Secrets {
+		if strings.EqualFold(hash, s.hash(secret, parts...)) {
+			return true
+		}
+	}
+	return false
+}
+
+func srsTimestamp(t time.Time) string {
+	days := t.Unix() / 86400
+	return string([]byte{srsBase32[(days>>5)&31], srsBase32[days&31]})
+}
+
+func srsTimestampValid(ts string, t time.Time, maxAge int) bool {
+	if len(ts) != 2 {
+		return false
+	}
+	hi := strings.IndexByte(srsBase32, strings.ToUpper(ts)[0])
+	lo := strings.IndexByte(srsBase32, strings.ToUpper(ts)[1])
+	if hi < 0 || lo < 0 {
+		return false
+	}
+
+	then := int64(hi<<5 | lo)
+	today := (t.Unix() / 86400) & 1023
+	age := (today - then + 1024) & 1023
+	return age <= int64(maxAge)
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var testSRS = SRSSetting{Domain: "fwd.example", Secrets: []string{"new", "old"}, MaxAge: 7}
+
+// srs0 builds an SRS0 address of testSRS stamped at t and signed with secret.
+func srs0(secret string, t time.Time, host, local string) string {
+	ts := srsTimestamp(t)
+	return "SRS0=" + testSRS.hash(secret, ts, host, local) + "=" + ts + "=" + host + "=" + local + "@" + testSRS.Domain
+}
+
+func TestSRSReverse(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	fresh := srs0("new", now, "example.net", "alice")
+	hash := fresh[5:9]
+
+	tests := []struct {
+		name string
+		addr string
+		want string
+		err  error
+	}{
+		{"current secret", fresh, "alice@example.net", nil},
+		{"rotated secret", srs0("old", now, "example.net", "alice"), "alice@example.net", nil},
+		{"lowercased", strings.ToLower(fresh), "alice@example.net", nil},
+		{"unknown secret", srs0("other", now, "example.net", "alice"), "", ErrSRSHash},
+		{"tampered local part", strings.Replace(fresh, "=alice@", "=mallory@", 1), "", ErrSRSHash},
+		{"tampered hash", strings.Replace(fresh, hash, "AAAA", 1), "", ErrSRSHash},
+		{"last valid day", srs0("new", now.Add(-7*day), "example.net", "alice"), "alice@example.net", nil},
+		{"expired", srs0("new", now.Add(-8*day), "example.net", "alice"), "", ErrSRSTimestamp},
+		{"from the future", srs0("new", now.Add(2*day), "example.net", "alice"), "", ErrSRSTimestamp},
+		{"other domain", strings.Replace(fresh, "@fwd.example", "@else.example", 1), "", ErrSRSNotOurs},
+		{"plain address", "alice@fwd.example", "", ErrSRSNotOurs},
+		{"missing fields", "SRS0=abcd=xx@fwd.example", "", ErrSRSSyntax},
+		{"SRS1 missing fields", "SRS1=abcd@fwd.example", "", ErrSRSSyntax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testSRS.Reverse(tt.addr)
+			if err != tt.err {
+				t.Fatalf("Reverse(%q) error = %v, want %v", tt.addr, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Reverse(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSRSForward(t *testing.T) {
+	other := SRSSetting{Domain: "first.example", Secrets: []string{"theirs"}}
+	first, err := other.Forward("alice@example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained, err := testSRS.Forward(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rechained, err := SRSSetting{Domain: "third.example", Secrets: []string{"x"}}.Forward(chained)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		addr   string
+		prefix string
+	}{
+		{"plain", "alice@example.net", "SRS0="},
+		{"SRS0 of another forwarder", first, "SRS1="},
+		{"SRS1 keeps the first forwarder", rechained, "SRS1="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testSRS.Forward(tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got, tt.prefix) || !strings.HasSuffix(got, "@fwd.example") {
+				t.Errorf("Forward(%q) = %q", tt.addr, got)
+			}
+			if tt.prefix == "SRS1=" && !strings.Contains(got, "=first.example==") {
+				t.Errorf("Forward(%q) = %q lost the first forwarder", tt.addr, got)
+			}
+			if !IsSRS(got) {
+				t.Errorf("IsSRS(%q) = false", got)
+			}
+		})
+	}
+
+	// A bounce to the chained address goes back to the first forwarder,
+	// which can reverse it to the sender.
+	back, err := testSRS.Reverse(chained)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != first {
+		t.Errorf("Reverse(%q) = %q, want %q", chained, back, first)
+	}
+	orig, err := other.Reverse(back)
+	if err != nil || orig != "alice@example.net" {
+		t.Errorf("Reverse(%q) = %q, %v", back, orig, err)
+	}
+
+	if got, _ := testSRS.Forward("bob@fwd.example"); got != "bob@fwd.example" {
+		t.Errorf("own address rewritten to %q", got)
+	}
+	if _, err := testSRS.Forward("nohost"); err != ErrSRSSyntax {
+		t.Errorf("Forward without host: %v", err)
+	}
+}
+
+func TestSRSTimestampWraps(t *testing.T) {
+	// Day numbers are kept modulo 1024, so a stamp from day 1023 is one
+	// day old on day 1024.
+	then := time.Unix(1023*86400, 0)
+	now := time.Unix(1024*86400, 0)
+	if !srsTimestampValid(srsTimestamp(then), now, 1) {
+		t.Error("stamp across the wrap is not valid")
+	}
+	for _, ts := range []string{"", "A", "A1", "!!"} {
+		if srsTimestampValid(ts, now, 21) {
+			t.Errorf("srsTimestampValid(%q) = true", ts)
+		}
+	}
+}
+
+func TestSRSRcpt(t *testing.T) {
+	conf := &Config{
+		SRS: testSRS,
+		Allocation: AllocationSetting{
+			ToDomains:      map[string]bool{"example.org": true},
+			BlacklistHosts: map[string]bool{"spam.example": true},
+		},
+	}
+	bounce := srs0("new", time.Now(), "example.net", "alice")
+
+	tests := []struct {
+		name, from, to string
+		code           int
+		returned       bool
+	}{
+		{"bounce to SRS address", "", bounce, 0, true},
+		{"bounce to local address", "", "b@example.org", 0, false},
+		{"bounce to unknown address", "", "b@example.com", 553, false},
+		{"reply to SRS address", "c@example.com", bounce, 0, true},
+		{"blacklisted sender to SRS address", "c@spam.example", bounce, 553, false},
+		{"blacklisted sender", "c@spam.example", "b@example.org", 553, false},
+		{"forged SRS address", "", strings.Replace(bounce, "=alice@", "=mallory@", 1), 550, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &session2{
+				be:   &Backend{},
+				st:   &smtp.ConnectionState{Hostname: "client.example", RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}},
+				ctx:  SetConfig(context.Background(), conf),
+				mail: true,
+				opts: &smtp.MailOptions{},
+				from: tt.from,
+			}
+			err := s.Rcpt(tt.to)
+			if tt.code != 0 {
+				if se, ok := asSMTPError(err); !ok || se.Code != tt.code {
+					t.Fatalf("Rcpt(%s) = %v, want %d", tt.to, err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rcpt(%s) = %v", tt.to, err)
+			}
+			if returned := len(s.returns) == 1; returned != tt.returned || len(s.to)+len(s.returns) != 1 {
+				t.Errorf("returns = %v, to = %v", s.returns, s.to)
+			}
+		})
+	}
+}
+
+func TestSRSEnvelope(t *testing.T) {
+	conf := &Config{SRS: testSRS, ProxyEnvelope: "proxy@example.org"}
+	if got := (&session2{from: ""}).envelope(conf); got != "" {
+		t.Errorf("bounce envelope = %q", got)
+	}
+	if got := (&session2{from: "a@example.net"}).envelope(conf); !strings.HasPrefix(got, "SRS0=") {
+		t.Errorf("envelope = %q", got)
+	}
+	conf.SRS = SRSSetting{}
+	if got := (&session2{from: "a@example.net"}).envelope(conf); got != "proxy@example.org" {
+		t.Errorf("envelope without SRS = %q", got)
+	}
+}
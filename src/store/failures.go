@@ -0,0 +1,124 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const failurePrefix = "_failures:"
+
+// Failures counts failed authentication attempts for a key such as a user
+// name or a remote address.
+type Failures struct {
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+func (f Failures) Locked(now time.Time) bool {
+	return now.Before(f.LockedUntil)
+}
+
+// expired reports whether f no longer counts: it isn't locked and its last
+// failure is older than window.
+func (f Failures) expired(now time.Time, window time.Duration) bool {
+	return window > 0 && !f.Locked(now) && now.Sub(f.Last) > window
+}
+
+var (
+	failureMu     sync.Mutex
+	failuresSwept time.Time
+)
+
+func getFailures(key string) Failures {
+	var f Failures
+	if current == nil {
+		return f
+	}
+
+	val, ok := current.Get(failurePrefix + key)
+	if !ok {
+		return f
+	}
+
+	var last, locked int64
+	if _, err := fmt.Sscanf(val, "%d %d %d", &f.Count, &last, &locked); err != nil {
+		return Failures{}
+	}
+	f.Last = time.Unix(last, 0)
+	f.LockedUntil = time.Unix(locked, 0)
+	return f
+}
+
+// GetFailures returns the record of key, deleting it when it expired.
+func GetFailures(key string, now time.Time, window time.Duration) Failures {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+
+	f := getFailures(key)
+	if !f.Last.IsZero() && f.expired(now, window) {
+		current.Delete(failurePrefix + key)
+		return Failures{}
+	}
+	return f
+}
+
+// AddFailure records a failed attempt for key. Failures older than window
+// are forgotten before counting. The updated record is returned.
+func AddFailure(key string, now time.Time, window time.Duration) Failures {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+
+	sweepFailures(now, window)
+
+	f := getFailures(key)
+	if f.expired(now, window) {
+		f = Failures{}
+	}
+	f.Count++
+	f.Last = now
+
+	putFailures(key, f)
+	return f
+}
+
+func Lock(key string, until time.Time) {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+
+	f := getFailures(key)
+	f.LockedUntil = until
+	putFailures(key, f)
+}
+
+func ClearFailures(key string) {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+
+	if current != nil {
+		current.Delete(failurePrefix + key)
+	}
+}
+
+// sweepFailures deletes the expired records once in a while, as the keys
+// of failed logins are chosen by the clients.
+func sweepFailures(now time.Time, window time.Duration) {
+	if current == nil || now.Sub(failuresSwept) < time.Minute {
+		return
+	}
+	failuresSwept = now
+
+	for _, key := range current.Keys(failurePrefix) {
+		if getFailures(key[len(failurePrefix):]).expired(now, window) {
+			current.Delete(key)
+		}
+	}
+}
+
+func putFailures(key string, f Failures) {
+	if current == nil {
+		return
+	}
+	current.Set(failurePrefix+key, fmt.Sprintf("%d %d %d", f.Count, f.Last.Unix(), f.LockedUntil.Unix()))
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailuresExpire(t *testing.T) {
+	m := useMapStore(t)
+	failuresSwept = time.Time{}
+	now := time.Unix(1600000000, 0)
+	window := 10 * time.Minute
+
+	AddFailure("alice", now, window)
+	AddFailure("bob", now, window)
+	Lock("bob", now.Add(time.Hour))
+	if f := GetFailures("alice", now.Add(window), window); f.Count != 1 {
+		t.Fatalf("alice within window = %+v", f)
+	}
+
+	later := now.Add(window + time.Second)
+	if f := GetFailures("alice", later, window); f.Count != 0 {
+		t.Errorf("alice after window = %+v", f)
+	}
+	if _, ok := m[failurePrefix+"alice"]; ok {
+		t.Error("expired record of alice kept")
+	}
+	if f := GetFailures("bob", later, window); !f.Locked(later) {
+		t.Errorf("bob unlocked: %+v", f)
+	}
+
+	// The sweep drops the records nobody reads again, but not locked ones.
+	AddFailure("carol", now, window)
+	AddFailure("dave", later, window)
+	if _, ok := m[failurePrefix+"carol"]; ok {
+		t.Error("expired record of carol not swept")
+	}
+	for _, key := range []string{"bob", "dave"} {
+		if _, ok := m[failurePrefix+key]; !ok {
+			t.Errorf("record of %s swept", key)
+		}
+	}
+}
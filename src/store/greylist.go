@@ -0,0 +1,167 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	greylistPrefix  = "_greylist:"
+	whitelistPrefix = "_greylist_awl:"
+)
+
+// Greylist is the state of one greylisting triplet. Passed is zero until
+// the client has retried after the initial delay.
+type Greylist struct {
+	First  time.Time
+	Passed time.Time
+	Last   time.Time
+}
+
+// expired reports whether g is forgotten: it wasn't retried within window,
+// or it passed but wasn't seen again within lifetime.
+func (g Greylist) expired(now time.Time, window, lifetime time.Duration) bool {
+	if g.Passed.IsZero() {
+		return now.Sub(g.First) > window
+	}
+	return now.Sub(g.Last) > lifetime
+}
+
+var (
+	greylistMu    sync.Mutex
+	greylistSwept time.Time
+)
+
+func getGreylist(key string) Greylist {
+	var g Greylist
+	if current == nil {
+		return g
+	}
+
+	val, ok := current.Get(greylistPrefix + key)
+	if !ok {
+		return g
+	}
+
+	var first, passed, last int64
+	if _, err := fmt.Sscanf(val, "%d %d %d", &first, &passed, &last); err != nil {
+		return Greylist{}
+	}
+	g.First = time.Unix(first, 0)
+	if passed != 0 {
+		g.Passed = time.Unix(passed, 0)
+	}
+	g.Last = time.Unix(last, 0)
+	return g
+}
+
+func putGreylist(key string, g Greylist) {
+	if current == nil {
+		return
+	}
+	var passed int64
+	if !g.Passed.IsZero() {
+		passed = g.Passed.Unix()
+	}
+	current.Set(greylistPrefix+key, fmt.Sprintf("%d %d %d", g.First.Unix(), passed, g.Last.Unix()))
+}
+
+// CheckGreylist records an attempt for the triplet key and reports whether
+// it may pass: the first attempt is deferred, a retry after delay and
+// within window passes, and a passed triplet keeps passing as long as it
+// is seen again within lifetime.
+func CheckGreylist(key string, now time.Time, delay, window, lifetime time.Duration) bool {
+	greylistMu.Lock()
+	defer greylistMu.Unlock()
+
+	sweepGreylist(now, window, lifetime)
+
+	g := getGreylist(key)
+	switch {
+	case g.First.IsZero(), g.expired(now, window, lifetime):
+		putGreylist(key, Greylist{First: now, Last: now})
+		return false
+	case !g.Passed.IsZero():
+	case now.Sub(g.First) < delay:
+		return false
+	default:
+		g.Passed = now
+	}
+
+	g.Last = now
+	putGreylist(key, g)
+	return true
+}
+
+// AddGreylistPass counts a delivery from a client network that got through
+// greylisting and returns the new count.
+func AddGreylistPass(network string, now time.Time, lifetime time.Duration) int {
+	greylistMu.Lock()
+	defer greylistMu.Unlock()
+
+	count, last := getWhitelist(network)
+	if whitelistExpired(last, now, lifetime) {
+		count = 0
+	}
+	count++
+	if current != nil {
+		current.Set(whitelistPrefix+network, fmt.Sprintf("%d %d", count, now.Unix()))
+	}
+	return count
+}
+
+// GreylistWhitelisted reports whether network has made at least n passing
+// deliveries, the last one within lifetime.
+func GreylistWhitelisted(network string, now time.Time, n int, lifetime time.Duration) bool {
+	greylistMu.Lock()
+	defer greylistMu.Unlock()
+
+	count, last := getWhitelist(network)
+	if !last.IsZero() && whitelistExpired(last, now, lifetime) {
+		current.Delete(whitelistPrefix + network)
+		return false
+	}
+	return n > 0 && count >= n
+}
+
+func whitelistExpired(last, now time.Time, lifetime time.Duration) bool {
+	return lifetime > 0 && now.Sub(last) > lifetime
+}
+
+// sweepGreylist deletes the expired triplets and whitelist entries once in
+// a while, most triplets are never retried and so never read again.
+func sweepGreylist(now time.Time, window, lifetime time.Duration) {
+	if current == nil || now.Sub(greylistSwept) < time.Minute {
+		return
+	}
+	greylistSwept = now
+
+	for _, key := range current.Keys(greylistPrefix) {
+		if getGreylist(key[len(greylistPrefix):]).expired(now, window, lifetime) {
+			current.Delete(key)
+		}
+	}
+	for _, key := range current.Keys(whitelistPrefix) {
+		if _, last := getWhitelist(key[len(whitelistPrefix):]); whitelistExpired(last, now, lifetime) {
+			current.Delete(key)
+		}
+	}
+}
+
+func getWhitelist(network string) (int, time.Time) {
+	if current == nil {
+		return 0, time.Time{}
+	}
+	val, ok := current.Get(whitelistPrefix + network)
+	if !ok {
+		return 0, time.Time{}
+	}
+
+	var count int
+	var last int64
+	if _, err := fmt.Sscanf(val, "%d %d", &count, &last); err != nil {
+		return 0, time.Time{}
+	}
+	return count, time.Unix(last, 0)
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreylistExpire(t *testing.T) {
+	m := useMapStore(t)
+	greylistSwept = time.Time{}
+	now := time.Unix(1600000000, 0)
+	delay, window, lifetime := 5*time.Minute, time.Hour, 24*time.Hour
+
+	if CheckGreylist("new", now, delay, window, lifetime) {
+		t.Fatal("first attempt passed")
+	}
+	CheckGreylist("passed", now, delay, window, lifetime)
+	if !CheckGreylist("passed", now.Add(delay), delay, window, lifetime) {
+		t.Fatal("retry after delay deferred")
+	}
+	AddGreylistPass("192.0.2.0/24", now, lifetime)
+	AddGreylistPass("198.51.100.0/24", now.Add(delay), lifetime)
+
+	// The sweep drops the triplet that wasn't retried within window, the
+	// passed one is kept for lifetime.
+	later := now.Add(window + time.Minute)
+	CheckGreylist("other", later, delay, window, lifetime)
+	if _, ok := m[greylistPrefix+"new"]; ok {
+		t.Error("expired triplet not swept")
+	}
+	if _, ok := m[greylistPrefix+"passed"]; !ok {
+		t.Error("passed triplet swept")
+	}
+
+	// Reading an expired whitelist entry drops it.
+	expiry := now.Add(lifetime + time.Second)
+	if GreylistWhitelisted("192.0.2.0/24", expiry, 1, lifetime) {
+		t.Error("expired network whitelisted")
+	}
+	if _, ok := m[whitelistPrefix+"192.0.2.0/24"]; ok {
+		t.Error("expired whitelist entry kept")
+	}
+	if !GreylistWhitelisted("198.51.100.0/24", expiry, 1, lifetime) {
+		t.Error("network not whitelisted")
+	}
+
+	CheckGreylist("other", now.Add(2*lifetime), delay, window, lifetime)
+	for key := range m {
+		if key != greylistPrefix+"other" {
+			t.Errorf("%s not swept", key)
+		}
+	}
+}
@@ -11,6 +11,9 @@ var (
 type Store interface {
 	Set(string, string)
 	Get(string) (string, bool)
+	Delete(string)
+	// Keys returns the keys starting with prefix.
+	Keys(prefix string) []string
 	Close()
 }
 
@@ -30,6 +33,19 @@ func (s *bitStore) Get(key string) (string, bool) {
 	return "", false
 }
 
+func (s *bitStore) Delete(key string) {
+	_ = s.db.Delete([]byte(key))
+}
+
+func (s *bitStore) Keys(prefix string) []string {
+	var keys []string
+	_ = s.db.Scan([]byte(prefix), func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	return keys
+}
+
 func (s *bitStore) Close() {
 	s.db.Close()
 }
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+// mapStore is an in-memory Store for tests.
+type mapStore map[string]string
+
+func (m mapStore) Set(key, val string) { m[key] = val }
+
+func (m mapStore) Get(key string) (string, bool) {
+	val, ok := m[key]
+	return val, ok
+}
+
+func (m mapStore) Delete(key string) { delete(m, key) }
+
+func (m mapStore) Keys(prefix string) []string {
+	var keys []string
+	for k := range m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (m mapStore) Close() {}
+
+func useMapStore(t *testing.T) mapStore {
+	m := mapStore{}
+	old := current
+	current = m
+	t.Cleanup(func() { current = old })
+	return m
+}
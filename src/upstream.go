@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type HealthSetting struct {
+	// Interval between active EHLO/NOOP checks, zero disables them.
+	Interval time.Duration
+	// Threshold consecutive failures open the circuit of an upstream,
+	// which is then skipped for Cooldown.
+	Threshold int
+	Cooldown  time.Duration
+}
+
+var DefaultHealth = HealthSetting{
+	Interval:  30 * time.Second,
+	Threshold: 3,
+	Cooldown:  30 * time.Second,
+}
+
+func (h HealthSetting) orDefault() HealthSetting {
+	if h == (HealthSetting{}) {
+		return DefaultHealth
+	}
+	return h
+}
+
+type upstreamState struct {
+	failures  int
+	openUntil time.Time
+	lastErr   string
+}
+
+type UpstreamStatus struct {
+	Addr      string
+	Failures  int
+	Open      bool
+	OpenUntil time.Time
+	LastError string
+}
+
+func upstreamKey(up Upstream) string {
+	if up.LMTP {
+		return "unix:" + up.Addr
+	}
+	return up.Addr
+}
+
+func (be *Backend) upstreamState(up Upstream) *upstreamState {
+	if be.health == nil {
+		be.health = map[string]*upstreamState{}
+	}
+	st, ok := be.health[upstreamKey(up)]
+	if !ok {
+		st = new(upstreamState)
+		be.health[upstreamKey(up)] = st
+	}
+	return st
+}
+
+func (be *Backend) markSuccess(up Upstream) {
+	be.healthMu.Lock()
+	defer be.healthMu.Unlock()
+
+	st := be.upstreamState(up)
+	if !st.openUntil.IsZero() {
+		log.Println("[upstream]", up.Addr, "circuit closed")
+	}
+	st.failures = 0
+	st.openUntil = time.Time{}
+	st.lastErr = ""
+}
+
+func (be *Backend) markFailure(h HealthSetting, up Upstream, err error) {
+	be.healthMu.Lock()
+	defer be.healthMu.Unlock()
+
+	st := be.upstreamState(up)
+	st.failures++
+	st.lastErr = err.Error()
+	if h.Threshold > 0 && st.failures >= h.Threshold {
+		st.openUntil = time.Now().Add(h.Cooldown)
+		log.Printf("[upstream] %s circuit open for %s after %d failures: %s\n", up.Addr, h.Cooldown, st.failures, err)
+	}
+}
+
+func (be *Backend) available(up Upstream, now time.Time) bool {
+	be.healthMu.Lock()
+	defer be.healthMu.Unlock()
+
+	return !now.Before(be.upstreamState(up).openUntil)
+}
+
+// UpstreamStatus reports the health of every upstream seen so far.
+func (be *Backend) UpstreamStatus() []UpstreamStatus {
+	be.healthMu.Lock()
+	defer be.healthMu.Unlock()
+
+	now := time.Now()
+	var list []UpstreamStatus
+	for addr, st := range be.health {
+		list = append(list, UpstreamStatus{
+			Addr:      addr,
+			Failures:  st.failures,
+			Open:      now.Before(st.openUntil),
+			OpenUntil: st.openUntil,
+			LastError: st.lastErr,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// pool returns the upstreams for a route. The default pool is the backend's
+// own address when one was given to New, otherwise Config.Upstream.
+func (be *Backend) pool(conf *Config, name string) ([]Upstream, error) {
+	if name != "" {
+		list, ok := conf.Upstreams[name]
+		if !ok {
+			return nil, fmt.Errorf("smtp-proxy: unknown upstream %q", name)
+		}
+		return list, nil
+	}
+
+	if be.Addr != "" {
+		return []Upstream{{
+			Addr:      be.Addr,
+			Security:  be.Security,
+			TLSConfig: be.TLSConfig,
+			LMTP:      be.LMTP,
+			Host:      be.Host,
+		}}, nil
+	}
+	if len(conf.Upstream) == 0 {
+		return nil, errors.New("smtp-proxy: no upstream configured")
+	}
+	return conf.Upstream, nil
+}
+
+// candidates orders a pool for one delivery: lowest Priority first, a
+// weighted random order within the same priority, and upstreams with an
+// open circuit left out. If every circuit is open they are all returned so
+// that mail still has a chance to go out.
+func (be *Backend) candidates(list []Upstream) []Upstream {
+	byPriority := map[int][]Upstream{}
+	var priorities []int
+	for _, up := range list {
+		if _, ok := byPriority[up.Priority]; !ok {
+			priorities = append(priorities, up.Priority)
+		}
+		byPriority[up.Priority] = append(byPriority[up.Priority], up)
+	}
+	sort.Ints(priorities)
+
+	var ordered []Upstream
+	for _, p := range priorities {
+		ordered = append(ordered, weightedShuffle(byPriority[p])...)
+	}
+
+	now := time.Now()
+	var result []Upstream
+	for _, up := range ordered {
+		if be.available(up, now) {
+			result = append(result, up)
+		}
+	}
+	if len(result) == 0 {
+		return ordered
+	}
+	return result
+}
+
+func weightedShuffle(list []Upstream) []Upstream {
+	rest := append([]Upstream(nil), list...)
+	result := make([]Upstream, 0, len(list))
+
+	for len(rest) > 0 {
+		total := 0
+		for _, up := range rest {
+			total += weight(up)
+		}
+		n := rand.Intn(total)
+		for i, up := range rest {
+			n -= weight(up)
+			if n < 0 {
+				result = append(result, up)
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func weight(up Upstream) int {
+	if up.Weight <= 0 {
+		return 1
+	}
+	return up.Weight
+}
+
+// disabledPoll is how often a disabled background task looks again at the
+// config, in case a reload enabled it.
+var disabledPoll = time.Minute
+
+// RunHealthChecks connects to every configured upstream each interval and
+// sends EHLO and NOOP, until done is closed.
+func (be *Backend) RunHealthChecks(done <-chan struct{}) {
+	for {
+		wait := be.CurrentConfig().Health.orDefault().Interval
+		if wait <= 0 {
+			wait = disabledPoll
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		if h := be.CurrentConfig().Health.orDefault(); h.Interval > 0 {
+			be.checkUpstreams(h)
+		}
+	}
+}
+
+func (be *Backend) checkUpstreams(h HealthSetting) {
+	conf := be.CurrentConfig()
+
+	seen := map[string]bool{}
+	var all []Upstream
+	add := func(list []Upstream) {
+		for _, up := range list {
+			if !seen[upstreamKey(up)] {
+				seen[upstreamKey(up)] = true
+				all = append(all, up)
+			}
+		}
+	}
+	if def, err := be.pool(conf, ""); err == nil {
+		add(def)
+	}
+	for _, list := range conf.Upstreams {
+		add(list)
+	}
+
+	for _, up := range all {
+		if err := checkUpstream(up); err != nil {
+			log.Println("[health]", up.Addr, err)
+			be.markFailure(h, up, err)
+			continue
+		}
+		be.markSuccess(up)
+	}
+}
+
+func checkUpstream(up Upstream) error {
+	c, err := dial(up)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCandidates(t *testing.T) {
+	be := &Backend{}
+	a := Upstream{Addr: "a:25", Priority: 10}
+	b := Upstream{Addr: "b:25"}
+	c := Upstream{Addr: "c:25", Priority: 5}
+
+	got := be.candidates([]Upstream{a, b, c})
+	if len(got) != 3 || got[0].Addr != "b:25" || got[1].Addr != "c:25" || got[2].Addr != "a:25" {
+		t.Fatalf("priority order = %v", got)
+	}
+
+	// An open circuit leaves b out until the cooldown is over.
+	h := HealthSetting{Threshold: 2, Cooldown: time.Hour}
+	be.markFailure(h, b, net.ErrClosed)
+	if got := be.candidates([]Upstream{a, b}); len(got) != 2 {
+		t.Fatalf("b left out below the threshold: %v", got)
+	}
+	be.markFailure(h, b, net.ErrClosed)
+	if got := be.candidates([]Upstream{a, b}); len(got) != 1 || got[0].Addr != "a:25" {
+		t.Fatalf("open circuit = %v", got)
+	}
+	if got := be.candidates([]Upstream{b}); len(got) != 1 {
+		t.Fatalf("all circuits open = %v", got)
+	}
+
+	// Half-open: once the cooldown is over b is tried again, and one more
+	// failure opens it right away.
+	be.upstreamState(b).openUntil = time.Now().Add(-time.Second)
+	if got := be.candidates([]Upstream{a, b}); len(got) != 2 {
+		t.Fatalf("half-open = %v", got)
+	}
+	be.markFailure(h, b, net.ErrClosed)
+	if got := be.candidates([]Upstream{a, b}); len(got) != 1 {
+		t.Fatalf("failed half-open = %v", got)
+	}
+	be.upstreamState(b).openUntil = time.Now().Add(-time.Second)
+	be.markSuccess(b)
+	be.markFailure(h, b, net.ErrClosed)
+	if got := be.candidates([]Upstream{a, b}); len(got) != 2 {
+		t.Fatalf("success didn't reset the failures: %v", got)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	list := []Upstream{{Addr: "heavy", Weight: 3}, {Addr: "light"}, {Addr: "off", Weight: -1}}
+	first := map[string]int{}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		got := weightedShuffle(list)
+		if len(got) != 3 {
+			t.Fatalf("shuffle = %v", got)
+		}
+		first[got[0].Addr]++
+	}
+	// A weight below 1 counts as 1, so heavy comes first 3 times in 5.
+	if r := float64(first["heavy"]) / n; r < 0.55 || r > 0.65 {
+		t.Errorf("heavy first %.2f of the time, want 0.60", r)
+	}
+	if r := float64(first["off"]) / n; r < 0.15 || r > 0.25 {
+		t.Errorf("negative weight first %.2f of the time, want 0.20", r)
+	}
+}
+
+func TestRunHealthChecksAfterReload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	old := disabledPoll
+	disabledPoll = 10 * time.Millisecond
+	defer func() { disabledPoll = old }()
+
+	up := []Upstream{{Addr: addr, Security: SecurityNone}}
+	be := &Backend{Config: &Config{Upstream: up, Health: HealthSetting{Threshold: 1, Cooldown: time.Hour}}}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		be.RunHealthChecks(done)
+		close(exited)
+	}()
+	defer func() {
+		close(done)
+		<-exited
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if st := be.UpstreamStatus(); len(st) != 0 {
+		t.Fatalf("disabled checks ran: %+v", st)
+	}
+
+	be.current.Store(&Config{Upstream: up, Health: HealthSetting{Interval: 10 * time.Millisecond, Threshold: 1, Cooldown: time.Hour}})
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st := be.UpstreamStatus(); len(st) == 1 && st[0].Open {
+			return
+		}
+	}
+	t.Fatal("checks not resumed after the reload")
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"strings"
+	"time"
+)
+
+// VirusScanner looks for malware in a message. It returns the name of what
+// it found, empty when the message is clean.
+type VirusScanner interface {
+	Scan(msg []byte) (string, error)
+}
+
+// VirusSetting decides what happens to infected mail. Action is
+// ActionReject, ActionQuarantine, which needs Config.QuarantineTo, or
+// ActionStrip, which replaces the infected parts of a multipart message and
+// rejects when that doesn't clean it.
+// DefaultAction is used while the scanner fails: ActionAccept lets mail
+// through unscanned, ActionTempfail refuses it.
+type VirusSetting struct {
+	Scanner       VirusScanner
+	Action        PolicyAction
+	DefaultAction PolicyAction
+}
+
+const DefaultClamdTimeout = 60 * time.Second
+
+// clamdChunk stays below the default StreamMaxLength of clamd.
+const clamdChunk = 1 << 16
+
+// ClamdScanner sends the message to clamd with INSTREAM.
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+func (sc *ClamdScanner) Scan(msg []byte) (string, error) {
+	timeout := sc.Timeout
+	if timeout == 0 {
+		timeout = DefaultClamdTimeout
+	}
+	conn, err := net.DialTimeout(sc.Network, sc.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(msg) > 0 {
+		chunk := msg
+		if len(chunk) > clamdChunk {
+			chunk = chunk[:clamdChunk]
+		}
+		msg = msg[len(chunk):]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		w.Write(size)
+		w.Write(chunk)
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	// stream: OK, stream: Eicar-Signature FOUND or ... ERROR
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		reply = strings.TrimSuffix(reply, " FOUND")
+		return strings.TrimSpace(reply[strings.IndexByte(reply, ':')+1:]), nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+var errNotStripped = errors.New("infected parts could not be removed")
+
+// check scans msg. It returns the message to pass on with X-Virus-Scanned
+// added, and the name of the malware found in it when that doesn't refuse
+// the message.
+func (v VirusSetting) check(conf *Config, msg []byte) ([]byte, string, error) {
+	if v.Scanner == nil {
+		return msg, "", nil
+	}
+	msg = stripFields(msg, "X-Virus-Scanned")
+
+	virus, err := v.Scanner.Scan(msg)
+	if err != nil {
+		log.Printf("[clamd] %s, %s\r\n", err, v.DefaultAction)
+		if v.DefaultAction == ActionTempfail {
+			return nil, "", NewScanTempError()
+		}
+		return msg, "", nil
+	}
+
+	if virus != "" {
+		switch v.Action {
+		case ActionQuarantine:
+		case ActionStrip:
+			if msg, err = v.strip(msg); err != nil {
+				log.Printf("[clamd] %s: %s\r\n", virus, err)
+				return nil, "", NewVirusError(virus)
+			}
+		default:
+			return nil, "", NewVirusError(virus)
+		}
+	}
+
+	header := fmt.Sprintf("X-Virus-Scanned: clamd at %s\r\n", conf.ServerName)
+	return append([]byte(header), msg...), virus, nil
+}
+
+// strip replaces the infected top level parts of a multipart message with
+// a note.
+func (v VirusSetting) strip(msg []byte) ([]byte, error) {
+	fields, body := splitMessage(msg)
+	var boundary string
+	for _, f := range fields {
+		if strings.EqualFold(fieldName(f), "Content-Type") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(fieldValue(f)))
+			if err == nil && strings.HasPrefix(mt, "multipart/") {
+				boundary = params["boundary"]
+			}
+			break
+		}
+	}
+	if boundary == "" {
+		return nil, errNotStripped
+	}
+
+	// Part n runs from the end of delimiter line n to the start of the
+	// next one.
+	delim := []byte("--" + boundary)
+	var starts, ends []int
+	for off := 0; off < len(body); {
+		end := len(body)
+		if l := bytes.IndexByte(body[off:], '\n'); l >= 0 {
+			end = off + l + 1
+		}
+		line := bytes.TrimRight(body[off:end], " \t\r\n")
+		if bytes.HasPrefix(line, delim) {
+			if rest := line[len(delim):]; len(rest) == 0 || string(rest) == "--" {
+				starts, ends = append(starts, off), append(ends, end)
+				if len(rest) != 0 {
+					break
+				}
+			}
+		}
+		off = end
+	}
+
+	if len(starts) == 0 {
+		return nil, errNotStripped
+	}
+
+	out := new(bytes.Buffer)
+	for _, f := range fields {
+		out.WriteString(f)
+	}
+	out.WriteString("\r\n")
+	out.Write(body[:ends[0]])
+
+	stripped := 0
+	for n := 0; n < len(starts); n++ {
+		if n+1 == len(starts) {
+			out.Write(body[ends[n]:])
+			break
+		}
+		part := body[ends[n]:starts[n+1]]
+		virus, err := v.Scanner.Scan(decodePart(part))
+		if err != nil {
+			return nil, err
+		}
+		if virus == "" {
+			out.Write(part)
+		} else {
+			stripped++
+			fmt.Fprintf(out, "Content-Type: text/plain; charset=us-ascii\r\n\r\n"+
+				"An attachment infected with %s was removed.\r\n", virus)
+		}
+		out.Write(body[starts[n+1]:ends[n+1]])
+	}
+	if stripped == 0 {
+		return nil, errNotStripped
+	}
+
+	if virus, err := v.Scanner.Scan(out.Bytes()); err != nil || virus != "" {
+		return nil, errNotStripped
+	}
+	return out.Bytes(), nil
+}
+
+// decodePart returns the content of a MIME part without its transfer
+// encoding, as clamd only unpacks whole messages.
+func decodePart(part []byte) []byte {
+	fields, body := splitMessage(part)
+	var r io.Reader
+	for _, f := range fields {
+		if !strings.EqualFold(fieldName(f), "Content-Transfer-Encoding") {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(fieldValue(f))) {
+		case "base64":
+			r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body))
+		case "quoted-printable":
+			r = quotedprintable.NewReader(bytes.NewReader(body))
+		}
+	}
+	if r == nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers one INSTREAM request with reply, or with a FOUND when
+// reply is empty and the stream holds the EICAR string. The chunk sizes it
+// saw are sent on chunks.
+func fakeClamd(t *testing.T, reply string) (string, chan []int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	chunks := make(chan []int, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+			return
+		}
+		var sizes []int
+		stream := new(bytes.Buffer)
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			sizes = append(sizes, int(n))
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(stream, r, int64(n)); err != nil {
+				return
+			}
+		}
+		chunks <- sizes
+
+		if reply == "" {
+			reply = "stream: OK\x00"
+			if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+				reply = "stream: Eicar-Test-Signature FOUND\x00"
+			}
+		}
+		c.Write([]byte(reply))
+	}()
+	return ln.Addr().String(), chunks
+}
+
+func TestClamdScan(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), clamdChunk+10)
+	tests := []struct {
+		name    string
+		msg     []byte
+		reply   string
+		virus   string
+		chunks  []int
+		wantErr bool
+	}{
+		{"clean", []byte("Subject: hi\r\n\r\nbody\r\n"), "", "", []int{21, 0}, false},
+		{"infected", []byte("Subject: hi\r\n\r\n" + eicar + "\r\n"), "", "Eicar-Test-Signature", []int{85, 0}, false},
+		{"split in chunks", big, "", "", []int{clamdChunk, 10, 0}, false},
+		{"empty", nil, "", "", []int{0}, false},
+		{"without NUL", []byte("x"), "stream: OK\n", "", []int{1, 0}, false},
+		{"size limit", []byte("x"), "INSTREAM size limit exceeded. ERROR\x00", "", []int{1, 0}, true},
+		{"closed", []byte("x"), "\x00", "", []int{1, 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, chunks := fakeClamd(t, tt.reply)
+			sc := &ClamdScanner{Network: "tcp", Address: addr}
+			virus, err := sc.Scan(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if virus != tt.virus {
+				t.Errorf("virus = %q, want %q", virus, tt.virus)
+			}
+			if got := <-chunks; !equalInts(got, tt.chunks) {
+				t.Errorf("chunks = %v, want %v", got, tt.chunks)
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// eicarScanner finds the EICAR string in whatever it is given, also base64
+// encoded as clamd would after unpacking the message.
+type eicarScanner struct{ err error }
+
+const eicarBase64 = "WDVPIVAlQEFQWzRcUFpYNTQoUF4pN0NDKTd9JEVJQ0FSLVNUQU5EQVJELUFOVElWSVJVUy1URVNU"
+
+func (sc eicarScanner) Scan(msg []byte) (string, error) {
+	if sc.err != nil {
+		return "", sc.err
+	}
+	if bytes.Contains(msg, []byte(eicar)) || bytes.Contains(msg, []byte(eicarBase64)) {
+		return "Eicar-Test-Signature", nil
+	}
+	return "", nil
+}
+
+func TestVirusCheck(t *testing.T) {
+	conf := &Config{ServerName: "mx.example.org"}
+	clean := "X-Virus-Scanned: forged\r\nSubject: hi\r\n\r\nbody\r\n"
+	single := "Subject: hi\r\n\r\n" + eicar + "\r\n"
+	multipart := "Subject: hi\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"preamble\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\n\r\n" + eicar + "\r\n" +
+		"--b--\r\n"
+	encoded := strings.Replace(multipart, "application/octet-stream\r\n\r\n"+eicar,
+		"application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n"+
+			eicarBase64+"\r\nLUZJTEUhJEgrSCo=", 1)
+	onlyPart := "Subject: hi\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\n\r\n" + eicar + "\r\n--b--\r\n"
+
+	tests := []struct {
+		name    string
+		scanner eicarScanner
+		setting VirusSetting
+		msg     string
+		code    int
+		virus   string
+		removed bool
+		kept    string
+	}{
+		{"clean", eicarScanner{}, VirusSetting{Action: ActionReject}, clean, 0, "", false, ""},
+		{"reject", eicarScanner{}, VirusSetting{Action: ActionReject}, single, 554, "", false, ""},
+		{"quarantine", eicarScanner{}, VirusSetting{Action: ActionQuarantine}, single, 0, "Eicar-Test-Signature", false, ""},
+		{"strip attachment", eicarScanner{}, VirusSetting{Action: ActionStrip}, multipart, 0, "Eicar-Test-Signature", true, "hello\r\n"},
+		{"strip encoded attachment", eicarScanner{}, VirusSetting{Action: ActionStrip}, encoded, 0, "Eicar-Test-Signature", true, "hello\r\n"},
+		{"strip single part", eicarScanner{}, VirusSetting{Action: ActionStrip}, single, 554, "", false, ""},
+		{"strip the only part", eicarScanner{}, VirusSetting{Action: ActionStrip}, onlyPart, 0, "Eicar-Test-Signature", true, ""},
+		{"scanner down, accept", eicarScanner{errors.New("down")}, VirusSetting{DefaultAction: ActionAccept}, single, 0, "", false, ""},
+		{"scanner down, tempfail", eicarScanner{errors.New("down")}, VirusSetting{DefaultAction: ActionTempfail}, single, 451, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.setting
+			v.Scanner = tt.scanner
+			out, virus, err := v.check(conf, []byte(tt.msg))
+			if tt.code != 0 {
+				se, ok := asSMTPError(err)
+				if !ok || se.Code != tt.code {
+					t.Fatalf("err = %v, want %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if virus != tt.virus {
+				t.Errorf("virus = %q, want %q", virus, tt.virus)
+			}
+			if tt.scanner.err == nil && !strings.HasPrefix(string(out), "X-Virus-Scanned: clamd at mx.example.org\r\n") {
+				t.Errorf("no X-Virus-Scanned in %q", out)
+			}
+			if strings.Contains(string(out), "forged") {
+				t.Error("incoming X-Virus-Scanned kept")
+			}
+			removed := strings.Contains(string(out), "An attachment infected with Eicar-Test-Signature was removed.")
+			if removed != tt.removed {
+				t.Errorf("message = %q", out)
+			}
+			if tt.removed && (!strings.Contains(string(out), tt.kept) || !strings.HasSuffix(string(out), "--b--\r\n")) {
+				t.Errorf("clean parts lost: %q", out)
+			}
+		})
+	}
+}